@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"backend/models"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// HandleChangePassword sets a new password for the user after checking their current password. All
+// of the user's other sessions and their personal access tokens are revoked, the session making the
+// request stays logged in.
+func (a *AuthService) HandleChangePassword(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Re-authenticate the user, throttled the same way as logins
+	attempts, ok := a.reserveReauthAttempt(w, r, dbUser.Username)
+	if !ok {
+		return
+	}
+	err = a.verifyPassword(dbUser.PasswordHash, reqBody.CurrentPassword)
+	if err != nil {
+		failLoginAndRespond(w)
+		return
+	}
+	if !a.releaseReauthAttempt(w, attempts) {
+		return
+	}
+
+	// Validate and hash the new password
+	err = a.Passwords.validate(dbUser.Username, reqBody.NewPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user := models.User{Password: reqBody.NewPassword}
+	err = a.hashPassword(&user)
+	if err != nil {
+		http.Error(w, "Error hashing password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Update the password and revoke the other sessions
+	err = a.DB.ChangePassword(dbUser.ID, user.PasswordHash, sessionIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error changing password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleDeleteAccount deletes the user and all of their data. Users with a password have to enter
+// it again, users that only log in through single sign-on don't have one. Users that are the only
+// owner of an organization have to transfer ownership first, so no organization is left without one.
+func (a *AuthService) HandleDeleteAccount(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Re-authenticate the user, throttled the same way as logins
+	if dbUser.PasswordHash != "" {
+		attempts, ok := a.reserveReauthAttempt(w, r, dbUser.Username)
+		if !ok {
+			return
+		}
+		err = a.verifyPassword(dbUser.PasswordHash, reqBody.Password)
+		if err != nil {
+			failLoginAndRespond(w)
+			return
+		}
+		if !a.releaseReauthAttempt(w, attempts) {
+			return
+		}
+	}
+
+	// Refuse to leave an organization without an owner
+	owned, err := a.DB.GetSoleOwnedOrganizations(dbUser.ID)
+	if err != nil {
+		http.Error(w, "Error fetching organizations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(owned) > 0 {
+		message := "An organization must have an owner, transfer ownership of " + strings.Join(owned, ", ")
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	// Delete the user, which also ends all of their sessions
+	err = a.DB.DeleteUser(dbUser.ID, dbUser.Username)
+	if err != nil {
+		http.Error(w, "Error deleting account: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
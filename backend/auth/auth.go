@@ -2,30 +2,48 @@ package auth
 
 import (
 	"backend/db"
+	"backend/mailer"
 	"backend/models"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type AuthService struct {
-	Secret []byte
-	DB     *db.DB
+	Keys      *KeySet
+	Passwords *PasswordPolicy
+	DB        *db.DB
+	WebAuthn  *webauthn.WebAuthn
+	OIDC      *OIDCProvider
+	Mailer    *mailer.Mailer
 }
 
-func NewAuthService(secret []byte, db *db.DB) (*AuthService, error) {
-	if len(secret) == 0 {
-		return nil, errors.New("secret cannot be empty")
+func NewAuthService(
+	keys *KeySet,
+	passwords *PasswordPolicy,
+	db *db.DB,
+	mailer *mailer.Mailer,
+) (*AuthService, error) {
+	if keys == nil {
+		return nil, errors.New("keys cannot be nil")
+	}
+	if passwords == nil {
+		return nil, errors.New("passwords cannot be nil")
 	}
 	if db == nil {
 		return nil, errors.New("db cannot be nil")
 	}
-	return &AuthService{Secret: secret, DB: db}, nil
+	if mailer == nil {
+		return nil, errors.New("mailer cannot be nil")
+	}
+	return &AuthService{Keys: keys, Passwords: passwords, DB: db, Mailer: mailer}, nil
 }
 
 func (a *AuthService) HandleSignUp(w http.ResponseWriter, r *http.Request) {
@@ -37,16 +55,37 @@ func (a *AuthService) HandleSignUp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Throttle repeated signups from the same address
+	_, until, err := a.reserveAttempts(map[throttle]string{signupThrottle: clientIP(r)})
+	if err != nil {
+		http.Error(w, "Error recording signup attempt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !until.IsZero() {
+		respondThrottled(w, until)
+		return
+	}
+
 	// Validate the username and password
 	if user.Username == "" || user.Password == "" {
 		http.Error(w, "Username and password must not be empty", http.StatusBadRequest)
 		return
 	}
-	if len(user.Password) < 5 {
-		http.Error(w, "Password must be at least 5 characters long", http.StatusBadRequest)
+	err = a.Passwords.validate(user.Username, user.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	// Validate the optional email address
+	if user.Email != "" {
+		user.Email, err = normalizeEmail(user.Email)
+		if err != nil {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Check if the username is already taken
 	exists, err := a.DB.UserExists(user.Username)
 	if err != nil {
@@ -66,14 +105,17 @@ func (a *AuthService) HandleSignUp(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create the user in the database
-	err = a.DB.CreateUser(user)
+	user.ID, err = a.DB.CreateUser(user)
 	if err != nil {
 		http.Error(w, "Error creating user: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if user.Email != "" {
+		a.sendVerificationEmailInBackground(user.ID, user.Username, user.Email)
+	}
 
 	// Create a token for the user and respond
-	a.createTokenAndRespond(user.Username, w)
+	a.createTokenAndRespond(user.ID, user.Username, w)
 }
 
 func (a *AuthService) HandleLogin(w http.ResponseWriter, r *http.Request) {
@@ -86,12 +128,30 @@ func (a *AuthService) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Throttle repeated failed logins of the username and from the same address
+	throttles := map[throttle]string{
+		usernameThrottle: responseUser.Username,
+		ipThrottle:       clientIP(r),
+	}
+	attempts, until, err := a.reserveAttempts(throttles)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error recording login attempt"})
+		return
+	}
+	if !until.IsZero() {
+		respondThrottled(w, until)
+		return
+	}
+
 	// Fetch the user from the database
 	dbUser, err := a.DB.GetUserByUsername(responseUser.Username)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+			// Spend as long as a real password check so the response time doesn't reveal that
+			// the user doesn't exist
+			a.verifyPassword(a.Passwords.dummyHash, responseUser.Password)
+			failLoginAndRespond(w)
 			return
 		}
 		w.WriteHeader(http.StatusInternalServerError)
@@ -102,17 +162,99 @@ func (a *AuthService) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	// Verify the password
 	err = a.verifyPassword(dbUser.PasswordHash, responseUser.Password)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+		failLoginAndRespond(w)
 		return
 	}
 
-	// Create a token for the user and respond
-	a.createTokenAndRespond(responseUser.Username, w)
+	// Upgrade a hash made with an older algorithm or weaker parameters while the password is known
+	if a.Passwords.needsRehash(dbUser.PasswordHash) {
+		a.rehashPassword(dbUser.ID, responseUser.Password)
+	}
+
+	// Users with two-factor authentication get a challenge instead of a token. The password was
+	// right, so the attempt doesn't count, and the second factor is throttled on its own.
+	if dbUser.TOTPEnabled {
+		err = a.releaseAttempts(attempts)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Error recording login attempt"})
+			return
+		}
+		a.createChallengeAndRespond(dbUser, w)
+		return
+	}
+
+	// Forget the failed logins of the username and create a token for the user
+	a.completeLoginAndRespond(attempts, dbUser.ID, dbUser.Username, w)
+}
+
+// failLoginAndRespond sends the same response for an unknown user, a wrong password or a wrong
+// second factor. The failed attempt has already been recorded by reserveAttempts.
+func failLoginAndRespond(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+}
+
+// reserveReauthAttempt reserves an attempt with the login throttles before a logged in user
+// enters their password again, so that a hijacked session cannot be used to guess it. It responds
+// and returns false if the username or the address is locked out. The returned attempts are
+// released with releaseReauthAttempt once the password turned out to be right.
+func (a *AuthService) reserveReauthAttempt(w http.ResponseWriter, r *http.Request, username string) ([]int, bool) {
+	attempts, until, err := a.reserveAttempts(map[throttle]string{
+		usernameThrottle: username,
+		ipThrottle:       clientIP(r),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error recording login attempt"})
+		return nil, false
+	}
+	if !until.IsZero() {
+		respondThrottled(w, until)
+		return nil, false
+	}
+	return attempts, true
+}
+
+// releaseReauthAttempt forgets the attempts reserved by reserveReauthAttempt. It responds and
+// returns false if that fails.
+func (a *AuthService) releaseReauthAttempt(w http.ResponseWriter, attempts []int) bool {
+	err := a.releaseAttempts(attempts)
+	if err != nil {
+		http.Error(w, "Error recording login attempt: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// completeLoginAndRespond forgets the attempt and the earlier failed logins of the username, so an
+// earlier typo doesn't count towards a lockout, and creates a token for the user.
+func (a *AuthService) completeLoginAndRespond(attempts []int, userID int, username string, w http.ResponseWriter) {
+	err := a.releaseAttempts(attempts)
+	if err == nil {
+		err = a.DB.ClearAuthAttempts(usernameThrottle.kind, username)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error recording login attempt"})
+		return
+	}
+
+	a.createTokenAndRespond(userID, username, w)
 }
 
 func (a *AuthService) HandleGetProfile(w http.ResponseWriter, r *http.Request, username string) {
-	json.NewEncoder(w).Encode(map[string]string{"username": username})
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":       dbUser.Username,
+		"email":          dbUser.Email,
+		"email_verified": dbUser.EmailVerified,
+	})
 }
 
 func (a *AuthService) HandleUpdateUsername(w http.ResponseWriter, r *http.Request, username string) {
@@ -127,8 +269,15 @@ func (a *AuthService) HandleUpdateUsername(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Fetch the user the token belongs to, the username in the token may be outdated
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Validate the current username
-	if update.CurrentUsername != username {
+	if update.CurrentUsername != dbUser.Username {
 		http.Error(w, "Current username does not match token", http.StatusBadRequest)
 		return
 	}
@@ -155,77 +304,190 @@ func (a *AuthService) HandleUpdateUsername(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Update the username in the database
-	err = a.DB.UpdateUsername(username, update.NewUsername)
+	err = a.DB.UpdateUsername(dbUser.ID, update.NewUsername)
 	if err != nil {
 		http.Error(w, "Error updating username: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// The current session's tokens carry the old username, so replace the session with a new one
+	err = a.DB.RevokeSession(sessionIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error revoking session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Create a token for the user and respond
-	a.createTokenAndRespond(update.NewUsername, w)
+	a.createTokenAndRespond(dbUser.ID, update.NewUsername, w)
 }
 
 // AuthMiddleware is a middleware function that handles authentication for incoming requests.
 // It checks for a valid authorization header in the request, verifies the token, and calls the
 // provided handler function with the authenticated username. If the authorization header is
-// missing or the token is invalid, it returns an error response. The handler function should have
-// the signature: func(http.ResponseWriter, *http.Request, string)
+// missing or the token is invalid or revoked, it returns an error response. The token's user ID and
+// session ID are stored in the request context, along with the organization the request acts in
+// and the user's role in it (see OrganizationFromContext). Personal access tokens are only
+// accepted if they have the admin scope. The username can be outdated after the user renamed
+// themselves, so handlers identify the user by UserIDFromContext. The handler function should have
+// the signature:
+// func(http.ResponseWriter, *http.Request, string)
 func (a *AuthService) AuthMiddleware(
 	handler func(http.ResponseWriter, *http.Request, string),
+) http.HandlerFunc {
+	return a.ScopedAuthMiddleware(ScopeAdmin, handler)
+}
+
+// SessionAuthMiddleware is AuthMiddleware for routes that manage the account, its credentials and
+// its tokens. They need a login session, so personal access tokens cannot call them, whatever their
+// scopes. Otherwise a leaked token could mint more tokens or take over the account.
+func (a *AuthService) SessionAuthMiddleware(
+	handler func(http.ResponseWriter, *http.Request, string),
+) http.HandlerFunc {
+	return a.AuthMiddleware(requireSession(handler))
+}
+
+// requireSession wraps an authenticated handler so that it rejects requests without a login
+// session, which are those made with a personal access token.
+func requireSession(
+	handler func(http.ResponseWriter, *http.Request, string),
+) func(http.ResponseWriter, *http.Request, string) {
+	return func(w http.ResponseWriter, r *http.Request, username string) {
+		if sessionIDFromContext(r.Context()) == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "This route needs a login session"})
+			return
+		}
+		handler(w, r, username)
+	}
+}
+
+// ScopedAuthMiddleware is AuthMiddleware for routes that personal access tokens with the given
+// scope may also call. Logged in users can call every route. Requests with a personal access token
+// have no session, so the session ID in their context is 0.
+func (a *AuthService) ScopedAuthMiddleware(
+	scope string,
+	handler func(http.ResponseWriter, *http.Request, string),
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
+		tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || tokenString == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "Missing authorization header"})
 			return
 		}
-		tokenString = tokenString[len("Bearer "):]
 
-		username, err := a.verifyToken(tokenString)
+		// Personal access tokens are looked up in the database and limited to their scopes
+		if isAccessToken(tokenString) {
+			token, username, err := a.DB.UseAccessToken(hashToken(tokenString))
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Invalid token"})
+				return
+			}
+			if !hasScope(token.Scopes, scope) {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Token is missing the " + scope + " scope"})
+				return
+			}
+
+			ctx := withUserID(r.Context(), token.UserID)
+			a.serveAuthenticated(w, r.WithContext(ctx), username, handler)
+			return
+		}
+
+		username, userID, sessionID, err := a.verifyToken(tokenString)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid token"})
 			return
 		}
 
-		handler(w, r, username)
+		ctx := withSessionID(withUserID(r.Context(), userID), sessionID)
+		a.serveAuthenticated(w, r.WithContext(ctx), username, handler)
 	}
 }
 
-// createTokenAndRespond creates a token for the given username and sends a response to the
-// provided http.ResponseWriter.
-func (a *AuthService) createTokenAndRespond(username string, w http.ResponseWriter) {
+// serveAuthenticated resolves the organization an authenticated request acts in, stores it in the
+// request context and calls the handler.
+func (a *AuthService) serveAuthenticated(
+	w http.ResponseWriter,
+	r *http.Request,
+	username string,
+	handler func(http.ResponseWriter, *http.Request, string),
+) {
+	orgID, role, err := a.resolveOrganization(r, UserIDFromContext(r.Context()))
+	if err != nil {
+		switch err {
+		case errInvalidOrganization:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid " + OrganizationHeader})
+		case errNotMember:
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Not a member of the organization"})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Error fetching organization"})
+		}
+		return
+	}
+
+	handler(w, r.WithContext(withOrganization(r.Context(), orgID, role)), username)
+}
+
+// createTokenAndRespond starts a new session for the given user, creates an access token and a
+// refresh token for it and sends them in a response to the provided http.ResponseWriter.
+func (a *AuthService) createTokenAndRespond(userID int, username string, w http.ResponseWriter) {
+	// Start a session with its first refresh token
+	sessionID, refreshToken, err := a.startSession(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error creating session"})
+		return
+	}
+
+	a.respondWithTokens(userID, username, sessionID, refreshToken, w)
+}
+
+// respondWithTokens creates an access token for the given session and sends it in a response
+// together with the session's refresh token.
+func (a *AuthService) respondWithTokens(
+	userID int,
+	username string,
+	sessionID int,
+	refreshToken string,
+	w http.ResponseWriter,
+) {
 	// Create a token for the user
-	tokenString, err := a.createToken(username)
+	tokenString, err := a.createToken(userID, username, sessionID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Error creating token"})
 		return
 	}
 
-	// Return a response body with the username and token
+	// Return a response body with the username and tokens
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":  "Operation successful",
-		"username": username,
-		"token":    tokenString,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Operation successful",
+		"username":      username,
+		"token":         tokenString,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+		"refresh_token": refreshToken,
 	})
 }
 
-// createToken generates a new JWT token for the given username.
-// It uses the HS256 signing method and sets the "username" claim to the provided username.
-// The token expires after 14 days.
+// createToken generates a new JWT access token for the given user and session.
+// It is signed with the current key of the key set and sets the "uid", "username" and "sid" claims
+// to the provided user ID, username and session ID. The token expires after 15 minutes.
 // It returns the generated token string and any error encountered during the process.
-func (a *AuthService) createToken(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"username": username,
-			"exp":      time.Now().Add(time.Hour * 24 * 14).Unix(),
-		})
-
-	tokenString, err := token.SignedString(a.Secret)
+func (a *AuthService) createToken(userID int, username string, sessionID int) (string, error) {
+	tokenString, err := a.Keys.sign(jwt.MapClaims{
+		"uid":      userID,
+		"username": username,
+		"sid":      sessionID,
+		"exp":      time.Now().Add(accessTokenTTL).Unix(),
+	})
 	if err != nil {
 		return "", err
 	}
@@ -233,42 +495,101 @@ func (a *AuthService) createToken(username string) (string, error) {
 	return tokenString, nil
 }
 
-// verifyToken verifies the authenticity of a JWT token and returns the username associated with it.
-// It takes a token string as input and returns the username and an error (if any).
-func (a *AuthService) verifyToken(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return a.Secret, nil
-	})
+// verifyToken verifies the authenticity of a JWT token and returns the username, user ID and
+// session ID associated with it. The token may be signed by any key in the key set, which is
+// looked up by the token's kid header, and is rejected if its session has been revoked.
+// It takes a token string as input and returns the username, user ID, session ID and an error
+// (if any).
+func (a *AuthService) verifyToken(tokenString string) (string, int, int, error) {
+	claims, err := a.parseToken(tokenString)
 	if err != nil {
-		return "", err
+		return "", 0, 0, err
 	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok || !token.Valid {
-		return "", errors.New("invalid token")
+	if _, ok := claims["purpose"]; ok {
+		return "", 0, 0, errors.New("not an access token")
 	}
 
 	username, ok := claims["username"].(string)
 	if !ok {
-		return "", errors.New("username claim not found")
+		return "", 0, 0, errors.New("username claim not found")
+	}
+	uid, ok := claims["uid"].(float64)
+	if !ok {
+		return "", 0, 0, errors.New("uid claim not found")
 	}
-	return username, nil
+	sid, ok := claims["sid"].(float64)
+	if !ok {
+		return "", 0, 0, errors.New("sid claim not found")
+	}
+
+	// Check that the session has not been revoked
+	active, err := a.DB.IsSessionActive(int(sid))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if !active {
+		return "", 0, 0, errors.New("session revoked")
+	}
+	return username, int(uid), int(sid), nil
 }
 
-// hashPassword hashes the user's password using bcrypt and updates the user's PasswordHash field.
+// verifyPurposeToken verifies a short-lived token that was issued for a single purpose, such as the
+// challenge token of a two-step login, and returns its claims. Such tokens are never accepted as
+// access tokens, and access tokens are never accepted in their place.
+func (a *AuthService) verifyPurposeToken(tokenString string, purpose string) (jwt.MapClaims, error) {
+	claims, err := a.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims["purpose"] != purpose {
+		return nil, errors.New("unexpected token purpose")
+	}
+	return claims, nil
+}
+
+// parseToken verifies the signature and expiry of a JWT token signed by any key in the key set and
+// returns its claims.
+func (a *AuthService) parseToken(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, a.Keys.keyFunc, jwt.WithValidMethods(a.Keys.methods()))
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// hashPassword hashes the user's password with the password policy's algorithm and updates the
+// user's PasswordHash field.
 // It takes a pointer to a User struct as input and returns an error if any.
 func (a *AuthService) hashPassword(user *models.User) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hashedPassword, err := a.Passwords.hash(user.Password)
 	if err != nil {
 		return err
 	}
 
-	user.PasswordHash = string(hashedPassword)
+	user.PasswordHash = hashedPassword
 	return nil
 }
 
 // verifyPassword compares a hashed password with a plain-text password and returns an error if
-// they don't match.
+// they don't match. Both Argon2id and bcrypt hashes are accepted.
 func (a *AuthService) verifyPassword(hash string, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return a.Passwords.verify(hash, password)
+}
+
+// rehashPassword replaces the stored hash of the user's password with one made by the current
+// password policy. Failures are only logged, since the old hash still works.
+func (a *AuthService) rehashPassword(userID int, password string) {
+	user := models.User{Password: password}
+	err := a.hashPassword(&user)
+	if err == nil {
+		err = a.DB.UpdatePasswordHash(userID, user.PasswordHash)
+	}
+	if err != nil {
+		log.Printf("Error rehashing password: %v", err)
+	}
 }
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is a key used to sign and verify tokens, identified by the kid header of the tokens
+// it signs. Keys that only hold a public key can verify tokens but not sign them.
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet holds every key that tokens may be signed with. New tokens are signed with the current
+// key, while tokens signed by any other key in the set stay valid until they expire, so a key can
+// be rotated by adding a new current key and removing the old one once its tokens have expired.
+type KeySet struct {
+	current *SigningKey
+	keys    map[string]*SigningKey
+}
+
+// NewKeySet creates a key set that signs new tokens with the key whose ID is current.
+func NewKeySet(current string, keys ...*SigningKey) (*KeySet, error) {
+	keySet := &KeySet{keys: make(map[string]*SigningKey)}
+	for _, key := range keys {
+		if _, ok := keySet.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		keySet.keys[key.ID] = key
+	}
+
+	keySet.current = keySet.keys[current]
+	if keySet.current == nil {
+		return nil, fmt.Errorf("current key %q not found", current)
+	}
+	if keySet.current.signKey == nil {
+		return nil, fmt.Errorf("current key %q has no private key", current)
+	}
+	return keySet, nil
+}
+
+// LoadKeySet loads the signing keys from the environment. JWT_KEYS is a comma-separated list of
+// kid:algorithm:value entries, where the value is a base64 encoded secret for HS256 and the path
+// to a PEM encoded private or public key for RS256 and EdDSA. JWT_CURRENT_KEY is the kid of the
+// key new tokens are signed with.
+func LoadKeySet() (*KeySet, error) {
+	entries := os.Getenv("JWT_KEYS")
+	if entries == "" {
+		return nil, errors.New("JWT_KEYS must be set")
+	}
+
+	var keys []*SigningKey
+	for _, entry := range strings.Split(entries, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid JWT_KEYS entry %q", entry)
+		}
+		key, err := parseSigningKey(parts[0], parts[1], parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", parts[0], err)
+		}
+		keys = append(keys, key)
+	}
+
+	return NewKeySet(os.Getenv("JWT_CURRENT_KEY"), keys...)
+}
+
+// parseSigningKey creates a signing key for the given algorithm from its configured value.
+func parseSigningKey(id string, alg string, value string) (*SigningKey, error) {
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 secret: %w", err)
+		}
+		if len(secret) < 32 {
+			return nil, errors.New("secret must be at least 32 bytes long")
+		}
+		return &SigningKey{
+			ID:        id,
+			Method:    jwt.SigningMethodHS256,
+			signKey:   secret,
+			verifyKey: secret,
+		}, nil
+	case jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg():
+		pemBytes, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		return parsePEMKey(id, alg, pemBytes)
+	}
+	return nil, fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// parsePEMKey parses a PEM encoded RSA or Ed25519 key. Private keys can sign and verify, public
+// keys can only verify.
+func parsePEMKey(id string, alg string, pemBytes []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{ID: id}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.signKey, key.verifyKey = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.verifyKey = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.signKey, key.verifyKey = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.verifyKey = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+	if key.Method.Alg() != alg {
+		return nil, fmt.Errorf("key type does not match algorithm %q", alg)
+	}
+	return key, nil
+}
+
+// sign signs the claims with the current key, setting the kid header to its ID.
+func (k *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.current.Method, claims)
+	token.Header["kid"] = k.current.ID
+	return token.SignedString(k.current.signKey)
+}
+
+// keyFunc looks up the verification key for a token from its kid header. It is meant to be passed
+// to jwt.Parse.
+func (k *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("missing kid header")
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+	return key.verifyKey, nil
+}
+
+// methods returns the algorithms of the keys in the set.
+func (k *KeySet) methods() []string {
+	var methods []string
+	for _, key := range k.keys {
+		methods = append(methods, key.Method.Alg())
+	}
+	return methods
+}
+
+// HandleGetJWKS serves the public keys of the asymmetric keys in the set as a JSON Web Key Set, so
+// that other services can verify tokens without sharing a secret. HS256 keys are never published.
+func (k *KeySet) HandleGetJWKS(w http.ResponseWriter, r *http.Request) {
+	jwks := []map[string]string{}
+	for _, key := range k.keys {
+		jwk := map[string]string{
+			"kid": key.ID,
+			"alg": key.Method.Alg(),
+			"use": "sig",
+		}
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwks})
+}
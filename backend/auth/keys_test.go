@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signWith signs a token with the claims of an access token, the given kid header and key.
+func signWith(t *testing.T, method jwt.SigningMethod, kid interface{}, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"uid": 1, "username": "alice", "sid": 1})
+	if kid != nil {
+		token.Header["kid"] = kid
+	}
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenString
+}
+
+func TestKeySetParseToken(t *testing.T) {
+	hmacSecret := bytes.Repeat([]byte{7}, 32)
+	hmacKey, err := parseSigningKey("hs", "HS256", base64.StdEncoding.EncodeToString(hmacSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, err := parsePEMKey("ed", "EdDSA", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeySet("hs", hmacKey, edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &AuthService{Keys: keys}
+	signed, err := keys.sign(jwt.MapClaims{"uid": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"signed by the current key", signed, false},
+		{"signed by another key in the set", signWith(t, jwt.SigningMethodEdDSA, "ed", private), false},
+		{"kid of another key", signWith(t, jwt.SigningMethodHS256, "ed", hmacSecret), true},
+		// The public key of an asymmetric key must never be accepted as an HMAC secret
+		{"public key as HMAC secret", signWith(t, jwt.SigningMethodHS256, "ed", []byte(public)), true},
+		{"algorithm of another key", signWith(t, jwt.SigningMethodEdDSA, "hs", private), true},
+		{"unknown kid", signWith(t, jwt.SigningMethodHS256, "other", hmacSecret), true},
+		{"missing kid", signWith(t, jwt.SigningMethodHS256, nil, hmacSecret), true},
+		{"kid that is not a string", signWith(t, jwt.SigningMethodHS256, 1, hmacSecret), true},
+		{
+			"unsigned",
+			signWith(t, jwt.SigningMethodNone, "hs", jwt.UnsafeAllowNoneSignatureType),
+			true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := a.parseToken(test.token)
+			if (err != nil) != test.wantErr {
+				t.Errorf("parseToken() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewKeySet(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	hmacKey, err := parseSigningKey("hs", "HS256", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicOnly := &SigningKey{ID: "ed", Method: jwt.SigningMethodEdDSA, verifyKey: public}
+
+	tests := []struct {
+		name    string
+		current string
+		keys    []*SigningKey
+		wantErr bool
+	}{
+		{"valid", "hs", []*SigningKey{hmacKey, publicOnly}, false},
+		{"unknown current key", "other", []*SigningKey{hmacKey}, true},
+		{"current key without a private key", "ed", []*SigningKey{hmacKey, publicOnly}, true},
+		{"duplicate kid", "hs", []*SigningKey{hmacKey, hmacKey}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewKeySet(test.current, test.keys...)
+			if (err != nil) != test.wantErr {
+				t.Errorf("NewKeySet() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+
+	tests := []struct {
+		name    string
+		alg     string
+		value   string
+		pem     []byte
+		wantErr bool
+	}{
+		{"HS256 secret", "HS256", secret, nil, false},
+		{"short HS256 secret", "HS256", base64.StdEncoding.EncodeToString([]byte("short")), nil, true},
+		{"HS256 secret that is not base64", "HS256", "!!!", nil, true},
+		{"unsupported algorithm", "HS512", "", nil, true},
+		{"Ed25519 key", "EdDSA", "", edPEM, false},
+		{"Ed25519 key for RS256", "RS256", "", edPEM, true},
+		{"no PEM data", "EdDSA", "", []byte("not a key"), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			if test.pem != nil {
+				_, err = parsePEMKey("kid", test.alg, test.pem)
+			} else {
+				_, err = parseSigningKey("kid", test.alg, test.value)
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
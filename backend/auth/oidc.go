@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"backend/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcLoginTTL is how long a user has to complete the login at the identity provider.
+	oidcLoginTTL = 10 * time.Minute
+
+	// oidcLoginPurpose is the purpose claim of the token that carries the state, nonce and PKCE
+	// verifier of a login between the redirect to the identity provider and the callback.
+	oidcLoginPurpose = "oidc-login"
+
+	// oidcCookieName is the name of the cookie that holds the oidc-login token.
+	oidcCookieName = "oidc_login"
+)
+
+// OIDCProvider is the OpenID Connect identity provider users can log in with.
+type OIDCProvider struct {
+	oauth2        oauth2.Config
+	verifier      *oidc.IDTokenVerifier
+	usernameClaim string
+	frontendURL   string
+	autoProvision bool
+	linkExisting  bool
+}
+
+// LoadOIDCProvider discovers the identity provider configured in the environment. It returns nil if
+// OIDC_ISSUER_URL is not set, which disables single sign-on. The configuration is:
+//   - OIDC_ISSUER_URL: the issuer, whose /.well-known/openid-configuration is fetched.
+//   - OIDC_CLIENT_ID and OIDC_CLIENT_SECRET: the client registered with the provider. The secret
+//     may be empty for public clients, since the login always uses PKCE.
+//   - OIDC_REDIRECT_URL: the URL of this backend's /oidc/callback route.
+//   - OIDC_FRONTEND_URL: where the browser is sent with the tokens once the login is complete.
+//   - OIDC_SCOPES: space-separated scopes to request in addition to openid.
+//   - OIDC_USERNAME_CLAIM: the ID token claim used as the username, preferred_username by default.
+//   - OIDC_AUTO_PROVISION: whether users that don't exist yet are created on their first login.
+//   - OIDC_LINK_EXISTING_USERS: whether a first login is linked to an existing user with the same
+//     username. Only enable this if the provider guarantees that users cannot choose the claim.
+func LoadOIDCProvider(ctx context.Context) (*OIDCProvider, error) {
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering OIDC provider: %w", err)
+	}
+
+	clientID := os.Getenv("OIDC_CLIENT_ID")
+	if clientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID must be set")
+	}
+	usernameClaim := os.Getenv("OIDC_USERNAME_CLAIM")
+	if usernameClaim == "" {
+		usernameClaim = "preferred_username"
+	}
+	autoProvision, _ := strconv.ParseBool(os.Getenv("OIDC_AUTO_PROVISION"))
+	linkExisting, _ := strconv.ParseBool(os.Getenv("OIDC_LINK_EXISTING_USERS"))
+
+	return &OIDCProvider{
+		oauth2: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+			Scopes:       append([]string{oidc.ScopeOpenID}, strings.Fields(os.Getenv("OIDC_SCOPES"))...),
+		},
+		verifier:      provider.Verifier(&oidc.Config{ClientID: clientID}),
+		usernameClaim: usernameClaim,
+		frontendURL:   os.Getenv("OIDC_FRONTEND_URL"),
+		autoProvision: autoProvision,
+		linkExisting:  linkExisting,
+	}, nil
+}
+
+// HandleOIDCLogin redirects the browser to the identity provider to start an authorization code
+// login with PKCE. The state, nonce and PKCE verifier are kept in a short-lived signed cookie.
+func (a *AuthService) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if a.OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		http.Error(w, "Error starting login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		http.Error(w, "Error starting login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	loginToken, err := a.Keys.sign(jwt.MapClaims{
+		"purpose":  oidcLoginPurpose,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(oidcLoginTTL).Unix(),
+	})
+	if err != nil {
+		http.Error(w, "Error creating token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    loginToken,
+		Path:     "/oidc",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   os.Getenv("ENV") != "development",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(
+		w,
+		r,
+		a.OIDC.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)),
+		http.StatusFound,
+	)
+}
+
+// HandleOIDCCallback completes the login when the identity provider redirects back. It exchanges
+// the authorization code, verifies the ID token, finds or provisions the user and redirects the
+// browser to the frontend with the usual tokens in the URL fragment, or with a challenge token if
+// the user has two-factor authentication. Errors are passed to the frontend the same way.
+func (a *AuthService) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if a.OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	// The login cookie is only used once
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Path: "/oidc", MaxAge: -1})
+
+	// Check that the callback belongs to a login started by this browser
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Login expired"}})
+		return
+	}
+	claims, err := a.verifyPurposeToken(cookie.Value, oidcLoginPurpose)
+	if err != nil || claims["state"] != r.URL.Query().Get("state") {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Login expired"}})
+		return
+	}
+	if errorCode := r.URL.Query().Get("error"); errorCode != "" {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Login failed: " + errorCode}})
+		return
+	}
+	nonce, _ := claims["nonce"].(string)
+	verifier, _ := claims["verifier"].(string)
+
+	// Exchange the code and verify the ID token
+	token, err := a.OIDC.oauth2.Exchange(
+		r.Context(),
+		r.URL.Query().Get("code"),
+		oauth2.VerifierOption(verifier),
+	)
+	if err != nil {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Login failed"}})
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Login failed"}})
+		return
+	}
+	idToken, err := a.OIDC.verifier.Verify(r.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != nonce {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Login failed"}})
+		return
+	}
+	var idClaims map[string]interface{}
+	err = idToken.Claims(&idClaims)
+	if err != nil {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Login failed"}})
+		return
+	}
+
+	// Find or provision the user
+	user, err := a.resolveOIDCUser(idToken.Issuer, idToken.Subject, idClaims)
+	if err != nil {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {err.Error()}})
+		return
+	}
+
+	// Users with two-factor authentication still need to enter a code on the frontend, which sends
+	// it to /login/2fa with the challenge token
+	if user.TOTPEnabled {
+		challengeToken, err := a.createChallengeToken(user)
+		if err != nil {
+			a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Error creating token"}})
+			return
+		}
+		a.OIDC.redirectToFrontend(w, r, url.Values{
+			"username":            {user.Username},
+			"two_factor_required": {"true"},
+			"challenge_token":     {challengeToken},
+		})
+		return
+	}
+
+	// Create the tokens for the user
+	sessionID, refreshToken, err := a.startSession(user.ID)
+	if err != nil {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Error creating session"}})
+		return
+	}
+	accessToken, err := a.createToken(user.ID, user.Username, sessionID)
+	if err != nil {
+		a.OIDC.redirectToFrontend(w, r, url.Values{"error": {"Error creating token"}})
+		return
+	}
+
+	a.OIDC.redirectToFrontend(w, r, url.Values{
+		"username":      {user.Username},
+		"token":         {accessToken},
+		"expires_in":    {strconv.Itoa(int(accessTokenTTL.Seconds()))},
+		"refresh_token": {refreshToken},
+	})
+}
+
+// resolveOIDCUser returns the user linked to the ID token's subject. On a user's first login, the
+// subject is linked to an existing user with the same username or a new user is provisioned,
+// depending on the configuration. The returned errors are meant to be shown to the user.
+func (a *AuthService) resolveOIDCUser(
+	issuer string,
+	subject string,
+	claims map[string]interface{},
+) (*models.User, error) {
+	user, err := a.DB.GetUserByOIDCIdentity(issuer, subject)
+	if err == nil {
+		return user, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, errors.New("Error fetching user")
+	}
+
+	username, _ := claims[a.OIDC.usernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("The identity provider did not send a %s claim", a.OIDC.usernameClaim)
+	}
+
+	// Link the subject to an existing user
+	user, err = a.DB.GetUserByUsername(username)
+	if err == nil {
+		if !a.OIDC.linkExisting {
+			return nil, errors.New("An account with this username already exists")
+		}
+		err = a.DB.LinkOIDCIdentity(user.ID, issuer, subject)
+		if err != nil {
+			return nil, errors.New("Error linking account")
+		}
+		return user, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, errors.New("Error fetching user")
+	}
+
+	// Provision a new user
+	if !a.OIDC.autoProvision {
+		return nil, errors.New("No account is linked to this identity")
+	}
+	userID, err := a.DB.CreateOIDCUser(username, issuer, subject)
+	if err != nil {
+		return nil, errors.New("Error creating user")
+	}
+	return &models.User{ID: userID, Username: username}, nil
+}
+
+// redirectToFrontend sends the browser to the frontend with the values in the URL fragment, which
+// browsers never send to servers or include in the Referer header.
+func (p *OIDCProvider) redirectToFrontend(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, p.frontendURL+"#"+values.Encode(), http.StatusFound)
+}
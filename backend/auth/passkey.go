@@ -0,0 +1,420 @@
+package auth
+
+import (
+	"backend/models"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// passkeyCeremonyTTL is how long a user has to complete a passkey registration or login.
+	passkeyCeremonyTTL = 5 * time.Minute
+
+	// Purpose claims of the tokens that carry the WebAuthn session data between the two requests
+	// of a ceremony.
+	passkeyRegistrationPurpose = "passkey-registration"
+	passkeyLoginPurpose        = "passkey-login"
+)
+
+// LoadWebAuthn configures the WebAuthn relying party from the environment. WEBAUTHN_RP_ID is the
+// domain passkeys are bound to and WEBAUTHN_RP_ORIGINS a comma-separated list of the frontend
+// origins allowed to use them. It returns nil if WEBAUTHN_RP_ID is not set, which disables passkeys.
+func LoadWebAuthn() (*webauthn.WebAuthn, error) {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		return nil, nil
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "TwoStepGPS",
+		RPOrigins:     strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ","),
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+	})
+}
+
+// passkeyUser adapts a user and their passkeys to the webauthn.User interface. The user handle is
+// the user's ID, so a discoverable login can find the user it belongs to.
+type passkeyUser struct {
+	user     *models.User
+	passkeys []models.Passkey
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.user.ID))
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	var credentials []webauthn.Credential
+	for _, passkey := range u.passkeys {
+		var transports []protocol.AuthenticatorTransport
+		for _, transport := range passkey.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              passkey.CredentialID,
+			PublicKey:       passkey.PublicKey,
+			AttestationType: passkey.AttestationType,
+			Transport:       transports,
+			Authenticator:   webauthn.Authenticator{SignCount: passkey.SignCount},
+		})
+	}
+	return credentials
+}
+
+// HandleBeginPasskeyRegistration starts registering a new passkey for the user. The response
+// contains the options for navigator.credentials.create() and a session token that has to be sent
+// back with the new credential to HandleFinishPasskeyRegistration.
+func (a *AuthService) HandleBeginPasskeyRegistration(w http.ResponseWriter, r *http.Request, username string) {
+	if a.WebAuthn == nil {
+		http.Error(w, "Passkeys are not configured", http.StatusNotImplemented)
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Name == "" {
+		http.Error(w, "Name must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	user, err := a.getPasskeyUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Exclude the user's existing passkeys so the same authenticator isn't registered twice
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	options, session, err := a.WebAuthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		http.Error(w, "Error starting registration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sessionToken, err := a.createPasskeySessionToken(passkeyRegistrationPurpose, session, jwt.MapClaims{
+		"uid":  user.user.ID,
+		"name": reqBody.Name,
+	})
+	if err != nil {
+		http.Error(w, "Error creating token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"options":       options,
+		"session_token": sessionToken,
+	})
+}
+
+// HandleFinishPasskeyRegistration verifies the credential created by the authenticator and stores
+// it as a new passkey of the user.
+func (a *AuthService) HandleFinishPasskeyRegistration(w http.ResponseWriter, r *http.Request, username string) {
+	if a.WebAuthn == nil {
+		http.Error(w, "Passkeys are not configured", http.StatusNotImplemented)
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		SessionToken string          `json:"session_token"`
+		Credential   json.RawMessage `json:"credential"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, session, err := a.verifyPasskeySessionToken(reqBody.SessionToken, passkeyRegistrationPurpose)
+	if err != nil {
+		http.Error(w, "Invalid session token", http.StatusBadRequest)
+		return
+	}
+	user, err := a.getPasskeyUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if uid, _ := claims["uid"].(float64); int(uid) != user.user.ID {
+		http.Error(w, "Invalid session token", http.StatusBadRequest)
+		return
+	}
+	name, _ := claims["name"].(string)
+
+	// Verify the new credential
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(reqBody.Credential))
+	if err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+	credential, err := a.WebAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		http.Error(w, "Invalid credential", http.StatusBadRequest)
+		return
+	}
+
+	var transports []string
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+	err = a.DB.AddPasskey(models.Passkey{
+		UserID:          user.user.ID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		SignCount:       credential.Authenticator.SignCount,
+	})
+	if err != nil {
+		http.Error(w, "Error saving passkey: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleBeginPasskeyLogin starts a passwordless login. The login is discoverable, so the user
+// picks a passkey in the browser instead of typing a username, and the response does not reveal
+// which accounts exist.
+func (a *AuthService) HandleBeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if a.WebAuthn == nil {
+		http.Error(w, "Passkeys are not configured", http.StatusNotImplemented)
+		return
+	}
+
+	options, session, err := a.WebAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		http.Error(w, "Error starting login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sessionToken, err := a.createPasskeySessionToken(passkeyLoginPurpose, session, jwt.MapClaims{})
+	if err != nil {
+		http.Error(w, "Error creating token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"options":       options,
+		"session_token": sessionToken,
+	})
+}
+
+// HandleFinishPasskeyLogin verifies the assertion signed by the user's passkey and responds with
+// the same tokens as a password login.
+func (a *AuthService) HandleFinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if a.WebAuthn == nil {
+		http.Error(w, "Passkeys are not configured", http.StatusNotImplemented)
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		SessionToken string          `json:"session_token"`
+		Credential   json.RawMessage `json:"credential"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, session, err := a.verifyPasskeySessionToken(reqBody.SessionToken, passkeyLoginPurpose)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid session token"})
+		return
+	}
+
+	// Verify the assertion against the passkey of the user it claims to belong to
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(reqBody.Credential))
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+		return
+	}
+	var user *passkeyUser
+	credential, err := a.WebAuthn.ValidateDiscoverableLogin(
+		func(rawID, userHandle []byte) (webauthn.User, error) {
+			userID, err := strconv.Atoi(string(userHandle))
+			if err != nil {
+				return nil, err
+			}
+			user, err = a.getPasskeyUserByID(userID)
+			return user, err
+		},
+		*session,
+		parsed,
+	)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+		return
+	}
+
+	// A sign counter that went backwards means the passkey may have been cloned
+	if credential.Authenticator.CloneWarning {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid credentials"})
+		return
+	}
+
+	// The session token is stateless, so each challenge is recorded to make it single-use. Sign
+	// counters can't prevent replays of authenticators that always report 0.
+	exp, _ := claims["exp"].(float64)
+	fresh, err := a.DB.UsePasskeyChallenge(session.Challenge, time.Unix(int64(exp), 0))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error recording challenge"})
+		return
+	}
+	if !fresh {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid session token"})
+		return
+	}
+	err = a.DB.UpdatePasskeyUsage(credential.ID, credential.Authenticator.SignCount)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error updating passkey"})
+		return
+	}
+
+	// Create a token for the user and respond
+	a.createTokenAndRespond(user.user.ID, user.user.Username, w)
+}
+
+// HandleGetPasskeys lists the passkeys registered by the user.
+func (a *AuthService) HandleGetPasskeys(w http.ResponseWriter, r *http.Request, username string) {
+	user, err := a.getPasskeyUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching passkeys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(user.passkeys)
+}
+
+// HandleDeletePasskey removes one of the user's passkeys.
+func (a *AuthService) HandleDeletePasskey(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		ID int `json:"id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deleted, err := a.DB.DeletePasskey(dbUser.ID, reqBody.ID)
+	if err != nil {
+		http.Error(w, "Error deleting passkey: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// getPasskeyUserByID loads the user with the given ID along with their passkeys.
+func (a *AuthService) getPasskeyUserByID(userID int) (*passkeyUser, error) {
+	dbUser, err := a.DB.GetUserByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("user not found")
+		}
+		return nil, err
+	}
+	passkeys, err := a.DB.GetPasskeys(dbUser.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &passkeyUser{user: dbUser, passkeys: passkeys}, nil
+}
+
+// createPasskeySessionToken signs the WebAuthn session data of a ceremony into a short-lived token,
+// so the backend doesn't need to keep state between the two requests of the ceremony.
+func (a *AuthService) createPasskeySessionToken(
+	purpose string,
+	session *webauthn.SessionData,
+	claims jwt.MapClaims,
+) (string, error) {
+	sessionJson, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	claims["purpose"] = purpose
+	claims["session"] = string(sessionJson)
+	claims["exp"] = time.Now().Add(passkeyCeremonyTTL).Unix()
+	return a.Keys.sign(claims)
+}
+
+// verifyPasskeySessionToken verifies a token created by createPasskeySessionToken and returns its
+// claims and the WebAuthn session data it carries.
+func (a *AuthService) verifyPasskeySessionToken(
+	tokenString string,
+	purpose string,
+) (jwt.MapClaims, *webauthn.SessionData, error) {
+	claims, err := a.verifyPurposeToken(tokenString, purpose)
+	if err != nil {
+		return nil, nil, err
+	}
+	sessionJson, ok := claims["session"].(string)
+	if !ok {
+		return nil, nil, errors.New("session claim not found")
+	}
+	var session webauthn.SessionData
+	err = json.Unmarshal([]byte(sessionJson), &session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claims, &session, nil
+}
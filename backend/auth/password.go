@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// argon2SaltLength and argon2KeyLength are the lengths in bytes of the salt and hash of new
+	// Argon2id password hashes.
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+
+	// maxPasswordLength caps the work a single password check can cause.
+	maxPasswordLength = 256
+
+	// bcryptMaxPasswordLength is the number of bytes bcrypt hashes. Longer passwords are rejected
+	// instead of being silently truncated.
+	bcryptMaxPasswordLength = 72
+)
+
+// argon2Params are the tunable parameters of Argon2id.
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// PasswordPolicy decides how passwords are hashed and which passwords are accepted.
+type PasswordPolicy struct {
+	algorithm  string
+	argon2     argon2Params
+	bcryptCost int
+	minLength  int
+	breached   map[string]bool
+
+	// argon2Slots holds a value for each Argon2id hash being computed. Its capacity is the number of
+	// hashes that fit in the memory budget, so concurrent logins can't exhaust the memory.
+	argon2Slots chan struct{}
+
+	// dummyHash is checked in place of the hash of a user that doesn't exist, so that such logins
+	// take as long as real ones.
+	dummyHash string
+}
+
+// LoadPasswordPolicy creates the password policy configured in the environment:
+//   - PASSWORD_HASH_ALGORITHM: argon2id (the default) or bcrypt.
+//   - PASSWORD_ARGON2_MEMORY_KIB, PASSWORD_ARGON2_ITERATIONS and PASSWORD_ARGON2_PARALLELISM: the
+//     Argon2id parameters, 65536 KiB, 3 and 2 by default.
+//   - PASSWORD_ARGON2_MEMORY_BUDGET_MIB: the memory that concurrent Argon2id hashes may use
+//     together, 256 MiB by default. Further hashes wait for a running one to finish. At least one
+//     hash runs at a time, even if it needs more memory than the budget.
+//   - PASSWORD_BCRYPT_COST: the bcrypt cost, 12 by default.
+//   - PASSWORD_MIN_LENGTH: the minimum length of new passwords, 8 by default.
+//   - PASSWORD_BREACHED_LIST: the path to a file of known breached passwords, one per line, that
+//     are rejected as new passwords regardless of case.
+//
+// Stored hashes that don't match the configured algorithm and parameters are replaced the next
+// time their user logs in.
+func LoadPasswordPolicy() (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		algorithm:  os.Getenv("PASSWORD_HASH_ALGORITHM"),
+		bcryptCost: 12,
+		minLength:  8,
+	}
+	if policy.algorithm == "" {
+		policy.algorithm = "argon2id"
+	}
+	if policy.algorithm != "argon2id" && policy.algorithm != "bcrypt" {
+		return nil, fmt.Errorf("unsupported password hash algorithm %q", policy.algorithm)
+	}
+
+	// Read the numeric settings, keeping the defaults for the ones that aren't set
+	memory, iterations, parallelism, budget := 64*1024, 3, 2, 256
+	settings := []struct {
+		name  string
+		value *int
+		min   int
+		max   int
+	}{
+		{"PASSWORD_ARGON2_MEMORY_KIB", &memory, 8 * 1024, 4 * 1024 * 1024},
+		{"PASSWORD_ARGON2_ITERATIONS", &iterations, 1, 100},
+		{"PASSWORD_ARGON2_PARALLELISM", &parallelism, 1, 255},
+		{"PASSWORD_ARGON2_MEMORY_BUDGET_MIB", &budget, 8, 1024 * 1024},
+		{"PASSWORD_BCRYPT_COST", &policy.bcryptCost, bcrypt.MinCost, bcrypt.MaxCost},
+		{"PASSWORD_MIN_LENGTH", &policy.minLength, 1, maxPasswordLength},
+	}
+	for _, setting := range settings {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < setting.min || n > setting.max {
+			return nil, fmt.Errorf("%s must be a number from %d to %d", setting.name, setting.min, setting.max)
+		}
+		*setting.value = n
+	}
+	policy.argon2 = argon2Params{
+		memory:      uint32(memory),
+		iterations:  uint32(iterations),
+		parallelism: uint8(parallelism),
+	}
+	policy.argon2Slots = make(chan struct{}, max(1, budget*1024/memory))
+
+	if path := os.Getenv("PASSWORD_BREACHED_LIST"); path != "" {
+		breached, err := loadBreachedPasswords(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading breached password list: %w", err)
+		}
+		policy.breached = breached
+	}
+
+	dummyHash, err := policy.hash("dummy password")
+	if err != nil {
+		return nil, err
+	}
+	policy.dummyHash = dummyHash
+
+	return policy, nil
+}
+
+// loadBreachedPasswords reads a file with one password per line into a set of lowercase passwords.
+func loadBreachedPasswords(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	breached := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			breached[strings.ToLower(password)] = true
+		}
+	}
+	return breached, scanner.Err()
+}
+
+// validate checks that a new password for the user meets the password requirements. The returned
+// error is meant to be shown to the user.
+func (p *PasswordPolicy) validate(username string, password string) error {
+	if len(password) < p.minLength {
+		return fmt.Errorf("Password must be at least %d characters long", p.minLength)
+	}
+	if len(password) > maxPasswordLength ||
+		(p.algorithm == "bcrypt" && len(password) > bcryptMaxPasswordLength) {
+		return errors.New("Password is too long")
+	}
+	lowerPassword := strings.ToLower(password)
+	if username != "" && strings.Contains(lowerPassword, strings.ToLower(username)) {
+		return errors.New("Password must not contain the username")
+	}
+	if p.breached[lowerPassword] {
+		return errors.New("Password is too common, it has appeared in a data breach")
+	}
+	return nil
+}
+
+// hash hashes a password with the configured algorithm. Argon2id hashes are stored in the PHC string
+// format, $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>.
+func (p *PasswordPolicy) hash(password string) (string, error) {
+	if p.algorithm == "bcrypt" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), p.bcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := p.argon2IDKey(password, salt, p.argon2, argon2KeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.argon2.memory,
+		p.argon2.iterations,
+		p.argon2.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verify compares a stored Argon2id or bcrypt hash with a plain-text password and returns an error
+// if they don't match.
+func (p *PasswordPolicy) verify(hash string, password string) error {
+	if len(password) > maxPasswordLength {
+		return errors.New("password too long")
+	}
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	}
+
+	params, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+	candidate := p.argon2IDKey(password, salt, params, uint32(len(key)))
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return errors.New("password does not match")
+	}
+	return nil
+}
+
+// argon2IDKey derives an Argon2id key from the password once one of the argon2Slots is free. Hashes
+// stored with other parameters than the configured ones also take one slot, until they are
+// replaced on their user's next login.
+func (p *PasswordPolicy) argon2IDKey(
+	password string,
+	salt []byte,
+	params argon2Params,
+	keyLength uint32,
+) []byte {
+	p.argon2Slots <- struct{}{}
+	defer func() { <-p.argon2Slots }()
+	return argon2.IDKey(
+		[]byte(password),
+		salt,
+		params.iterations,
+		params.memory,
+		params.parallelism,
+		keyLength,
+	)
+}
+
+// needsRehash reports whether a stored hash was made with another algorithm or other parameters
+// than the configured ones.
+func (p *PasswordPolicy) needsRehash(hash string) bool {
+	if p.algorithm == "bcrypt" {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != p.bcryptCost
+	}
+
+	params, _, key, err := parseArgon2Hash(hash)
+	return err != nil || params != p.argon2 || len(key) != argon2KeyLength
+}
+
+// parseArgon2Hash parses an Argon2id hash in the PHC string format.
+func parseArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	_, err := fmt.Sscanf(
+		parts[3],
+		"m=%d,t=%d,p=%d",
+		&params.memory,
+		&params.iterations,
+		&params.parallelism,
+	)
+	if err != nil || params.memory == 0 || params.iterations == 0 || params.parallelism == 0 {
+		return params, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+// setPasswordEnv sets the password policy variables for a test, cheap Argon2id parameters unless
+// overridden.
+func setPasswordEnv(t *testing.T, env map[string]string) {
+	defaults := map[string]string{
+		"PASSWORD_HASH_ALGORITHM":           "argon2id",
+		"PASSWORD_ARGON2_MEMORY_KIB":        "8192",
+		"PASSWORD_ARGON2_ITERATIONS":        "1",
+		"PASSWORD_ARGON2_PARALLELISM":       "1",
+		"PASSWORD_ARGON2_MEMORY_BUDGET_MIB": "",
+		"PASSWORD_BCRYPT_COST":              "4",
+		"PASSWORD_MIN_LENGTH":               "",
+		"PASSWORD_BREACHED_LIST":            "",
+	}
+	for name, value := range defaults {
+		if override, ok := env[name]; ok {
+			value = override
+		}
+		t.Setenv(name, value)
+	}
+}
+
+func TestLoadPasswordPolicyArgon2Slots(t *testing.T) {
+	tests := []struct {
+		memoryKiB string
+		budgetMiB string
+		want      int
+	}{
+		{"8192", "", 32},
+		{"65536", "", 4},
+		{"65536", "128", 2},
+		{"65536", "100", 1},
+		{"65536", "8", 1},
+	}
+	for _, test := range tests {
+		setPasswordEnv(t, map[string]string{
+			"PASSWORD_ARGON2_MEMORY_KIB":        test.memoryKiB,
+			"PASSWORD_ARGON2_MEMORY_BUDGET_MIB": test.budgetMiB,
+		})
+		policy, err := LoadPasswordPolicy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cap(policy.argon2Slots); got != test.want {
+			t.Errorf("%s KiB, %q MiB budget: %d slots, want %d", test.memoryKiB, test.budgetMiB, got, test.want)
+		}
+	}
+}
+
+func TestPasswordHashAndVerify(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		prefix    string
+	}{
+		{"argon2id", "$argon2id$v=19$m=8192,t=1,p=1$"},
+		{"bcrypt", "$2a$04$"},
+	}
+	for _, test := range tests {
+		t.Run(test.algorithm, func(t *testing.T) {
+			setPasswordEnv(t, map[string]string{"PASSWORD_HASH_ALGORITHM": test.algorithm})
+			policy, err := LoadPasswordPolicy()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hash, err := policy.hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hash, test.prefix) {
+				t.Errorf("hash = %q, want prefix %q", hash, test.prefix)
+			}
+			if err := policy.verify(hash, "correct horse"); err != nil {
+				t.Errorf("verify() with the right password = %v", err)
+			}
+			if err := policy.verify(hash, "wrong horse"); err == nil {
+				t.Error("verify() with a wrong password succeeded")
+			}
+			if policy.needsRehash(hash) {
+				t.Error("needsRehash() of a fresh hash = true")
+			}
+			if len(policy.argon2Slots) != 0 {
+				t.Errorf("%d argon2 slots still taken", len(policy.argon2Slots))
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Access policies of routes that can be served without logging in.
+const (
+	// AccessPublic routes can be called by anyone.
+	AccessPublic = "public"
+	// AccessAuthenticated routes need a token like the routes behind AuthMiddleware.
+	AccessAuthenticated = "authenticated"
+	// AccessShareToken routes can be called by anyone with the route's share token, passed in the
+	// share_token query parameter.
+	AccessShareToken = "share-token"
+)
+
+// minShareTokenLength keeps configured share tokens unguessable.
+const minShareTokenLength = 32
+
+// redactableFields are the device fields a Redaction can hide.
+var redactableFields = map[string]bool{
+	"display_name": true,
+	"nickname":     true,
+	"altitude":     true,
+	"angle":        true,
+	"speed":        true,
+	"velocity":     true,
+}
+
+// Redaction limits what anonymous requests see of the fleet.
+type Redaction struct {
+	// CoordinatePrecision is the number of decimal places coordinates are rounded to, or -1 to keep
+	// them exact.
+	CoordinatePrecision int
+	// Fields are the JSON names of the device fields that are left empty.
+	Fields map[string]bool
+	// DeviceIDs are the devices of the global fleet that are shown, or nil to show all of them.
+	DeviceIDs map[string]bool
+}
+
+// RoutePolicy decides who may call a route that can be served without logging in, and what
+// anonymous callers see. Requests with a token are always authenticated and never redacted.
+type RoutePolicy struct {
+	Access     string
+	Redaction  Redaction
+	shareToken string
+}
+
+// LoadRoutePolicy creates the policy configured in the environment for a route, with every variable
+// name starting with the given prefix:
+//   - <prefix>_ACCESS: public (the default), authenticated or share-token.
+//   - <prefix>_SHARE_TOKEN: the share token, at least 32 characters long, if the access is
+//     share-token.
+//   - <prefix>_COORDINATE_PRECISION: the number of decimal places coordinates are rounded to for
+//     anonymous requests, exact if empty. Two decimal places are about a kilometer.
+//   - <prefix>_REDACT: a comma-separated list of device fields hidden from anonymous requests, out
+//     of display_name, nickname, altitude, angle, speed and velocity.
+//   - <prefix>_DEVICE_IDS: a comma-separated list of the devices of the global fleet that
+//     anonymous requests see, all of them if empty.
+func LoadRoutePolicy(prefix string) (*RoutePolicy, error) {
+	policy := &RoutePolicy{
+		Access:     os.Getenv(prefix + "_ACCESS"),
+		Redaction:  Redaction{CoordinatePrecision: -1, Fields: make(map[string]bool)},
+		shareToken: os.Getenv(prefix + "_SHARE_TOKEN"),
+	}
+	switch policy.Access {
+	case "":
+		policy.Access = AccessPublic
+	case AccessPublic, AccessAuthenticated:
+	case AccessShareToken:
+		if len(policy.shareToken) < minShareTokenLength {
+			return nil, fmt.Errorf("%s_SHARE_TOKEN must be at least %d characters long", prefix, minShareTokenLength)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported %s_ACCESS %q", prefix, policy.Access)
+	}
+
+	if value := os.Getenv(prefix + "_COORDINATE_PRECISION"); value != "" {
+		precision, err := strconv.Atoi(value)
+		if err != nil || precision < 0 || precision > 8 {
+			return nil, fmt.Errorf("%s_COORDINATE_PRECISION must be a number from 0 to 8", prefix)
+		}
+		policy.Redaction.CoordinatePrecision = precision
+	}
+
+	for _, field := range strings.Split(os.Getenv(prefix+"_REDACT"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !redactableFields[field] {
+			return nil, fmt.Errorf("%s_REDACT: unknown field %q", prefix, field)
+		}
+		policy.Redaction.Fields[field] = true
+	}
+
+	for _, deviceID := range strings.Split(os.Getenv(prefix+"_DEVICE_IDS"), ",") {
+		deviceID = strings.TrimSpace(deviceID)
+		if deviceID == "" {
+			continue
+		}
+		if policy.Redaction.DeviceIDs == nil {
+			policy.Redaction.DeviceIDs = make(map[string]bool)
+		}
+		policy.Redaction.DeviceIDs[deviceID] = true
+	}
+
+	return policy, nil
+}
+
+// PolicyMiddleware serves a route according to its policy. Requests with an authorization header,
+// and every request to routes with the authenticated policy, go through ScopedAuthMiddleware with
+// the given scope. Other requests are passed to the handler with an empty username and the
+// policy's redaction in their context (see RedactionFromContext), once their share token has been
+// checked if the route needs one.
+func (a *AuthService) PolicyMiddleware(
+	policy *RoutePolicy,
+	scope string,
+	handler func(http.ResponseWriter, *http.Request, string),
+) http.HandlerFunc {
+	authenticated := a.ScopedAuthMiddleware(scope, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || policy.Access == AccessAuthenticated {
+			authenticated(w, r)
+			return
+		}
+
+		if policy.Access == AccessShareToken {
+			shareToken := r.URL.Query().Get("share_token")
+			if subtle.ConstantTimeCompare([]byte(shareToken), []byte(policy.shareToken)) != 1 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Invalid share token"})
+				return
+			}
+		}
+
+		handler(w, r.WithContext(withRedaction(r.Context(), &policy.Redaction)), "")
+	}
+}
+
+// withRedaction returns a copy of the context that carries the redaction of an anonymous request.
+func withRedaction(ctx context.Context, redaction *Redaction) context.Context {
+	return context.WithValue(ctx, redactionKey, redaction)
+}
+
+// RedactionFromContext returns the redaction stored by PolicyMiddleware for anonymous requests, or
+// nil if the request is authenticated.
+func RedactionFromContext(ctx context.Context) *Redaction {
+	redaction, _ := ctx.Value(redactionKey).(*Redaction)
+	return redaction
+}
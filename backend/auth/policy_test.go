@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestLoadRoutePolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		wantErr   bool
+		access    string
+		precision int
+		fields    map[string]bool
+		deviceIDs map[string]bool
+	}{
+		{
+			name:      "defaults",
+			env:       map[string]string{},
+			access:    AccessPublic,
+			precision: -1,
+			fields:    map[string]bool{},
+		},
+		{
+			name: "redacted",
+			env: map[string]string{
+				"TEST_COORDINATE_PRECISION": "2",
+				"TEST_REDACT":               "speed, nickname",
+				"TEST_DEVICE_IDS":           " a1,b2 ,,",
+			},
+			access:    AccessPublic,
+			precision: 2,
+			fields:    map[string]bool{"speed": true, "nickname": true},
+			deviceIDs: map[string]bool{"a1": true, "b2": true},
+		},
+		{
+			name:    "unknown access",
+			env:     map[string]string{"TEST_ACCESS": "everyone"},
+			wantErr: true,
+		},
+		{
+			name:    "short share token",
+			env:     map[string]string{"TEST_ACCESS": AccessShareToken, "TEST_SHARE_TOKEN": "short"},
+			wantErr: true,
+		},
+		{
+			name:    "precision out of range",
+			env:     map[string]string{"TEST_COORDINATE_PRECISION": "9"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			env:     map[string]string{"TEST_REDACT": "latitude"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"ACCESS", "SHARE_TOKEN", "COORDINATE_PRECISION", "REDACT", "DEVICE_IDS"} {
+				t.Setenv("TEST_"+name, test.env["TEST_"+name])
+			}
+			policy, err := LoadRoutePolicy("TEST")
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.Access != test.access {
+				t.Errorf("Access = %q, want %q", policy.Access, test.access)
+			}
+			if policy.Redaction.CoordinatePrecision != test.precision {
+				t.Errorf(
+					"CoordinatePrecision = %d, want %d",
+					policy.Redaction.CoordinatePrecision,
+					test.precision,
+				)
+			}
+			if !maps.Equal(policy.Redaction.Fields, test.fields) {
+				t.Errorf("Fields = %v, want %v", policy.Redaction.Fields, test.fields)
+			}
+			if !maps.Equal(policy.Redaction.DeviceIDs, test.deviceIDs) {
+				t.Errorf("DeviceIDs = %v, want %v", policy.Redaction.DeviceIDs, test.deviceIDs)
+			}
+			if test.deviceIDs == nil && policy.Redaction.DeviceIDs != nil {
+				t.Errorf("DeviceIDs = %v, want nil", policy.Redaction.DeviceIDs)
+			}
+		})
+	}
+}
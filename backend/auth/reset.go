@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"backend/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// passwordResetTTL is how long an emailed password reset token can be used.
+const passwordResetTTL = time.Hour
+
+// HandleUpdateEmail sets the email address that password reset links are sent to and sends a
+// verification email to it. An empty address removes it. The response is the same whether or not
+// another user has verified the address, see sendVerificationEmail.
+func (a *AuthService) HandleUpdateEmail(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var update struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if update.Email != "" {
+		update.Email, err = normalizeEmail(update.Email)
+		if err != nil {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Fetch the user
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Update the email address in the database
+	err = a.DB.UpdateEmail(dbUser.ID, update.Email)
+	if err != nil {
+		http.Error(w, "Error updating email address: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A new address has to be verified
+	if update.Email != "" && !strings.EqualFold(update.Email, dbUser.Email) {
+		a.sendVerificationEmailInBackground(dbUser.ID, dbUser.Username, update.Email)
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleForgotPassword emails a single-use password reset link to the user with the given email
+// address. The response is the same whether or not a user has the address, so that it cannot be
+// used to find out which addresses are registered. Requests are throttled per address and per IP,
+// whether or not an email is sent.
+func (a *AuthService) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil || reqBody.Email == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Check and record the request before anything is sent
+	email, err := normalizeEmail(reqBody.Email)
+	if err != nil {
+		email = strings.ToLower(strings.TrimSpace(reqBody.Email))
+	}
+	_, lockedUntil, err := a.reserveAttempts(map[throttle]string{
+		resetEmailThrottle: email,
+		resetIPThrottle:    clientIP(r),
+	})
+	if err != nil {
+		http.Error(w, "Error recording attempt: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !lockedUntil.IsZero() {
+		respondThrottled(w, lockedUntil)
+		return
+	}
+
+	// The email is sent in the background so the response time doesn't reveal whether it was sent
+	go a.sendPasswordReset(reqBody.Email)
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an account with this email address exists, a reset link has been sent",
+	})
+}
+
+// sendPasswordReset creates a password reset token for the user with the given email address and
+// emails it to them. Nothing is sent if no user has the address.
+func (a *AuthService) sendPasswordReset(email string) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return
+	}
+	user, err := a.DB.GetUserByEmail(email)
+	if err != nil {
+		return
+	}
+
+	// Deployments can require the address to be verified before a reset link is sent to it
+	requireVerified, _ := strconv.ParseBool(os.Getenv("REQUIRE_VERIFIED_EMAIL"))
+	if requireVerified && !user.EmailVerified {
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("Error creating password reset token: %v", err)
+		return
+	}
+	err = a.DB.CreatePasswordResetToken(user.ID, hashToken(token), time.Now().Add(passwordResetTTL))
+	if err != nil {
+		log.Printf("Error storing password reset token: %v", err)
+		return
+	}
+
+	link := os.Getenv("PASSWORD_RESET_URL") + "?" + url.Values{"token": {token}}.Encode()
+	err = a.Mailer.Send(
+		user.Email,
+		"Reset your TwoStepGPS password",
+		"Hi "+user.Username+",\n\n"+
+			"Open the link below within an hour to choose a new password:\n\n"+
+			link+"\n\n"+
+			"If you didn't ask to reset your password, you can ignore this email.\n",
+	)
+	if err != nil {
+		log.Printf("Error sending password reset email: %v", err)
+	}
+}
+
+// HandleResetPassword sets a new password using an emailed password reset token. The token can
+// only be used once, and all of the user's sessions and personal access tokens are revoked so they
+// have to log in again.
+func (a *AuthService) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil || reqBody.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Check the token before the new password, which can't contain the token's username
+	tokenHash := hashToken(reqBody.Token)
+	dbUser, err := a.DB.GetPasswordResetUser(tokenHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = a.Passwords.validate(dbUser.Username, reqBody.NewPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Hash the new password
+	var user models.User
+	user.Password = reqBody.NewPassword
+	err = a.hashPassword(&user)
+	if err != nil {
+		http.Error(w, "Error hashing password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Use the token to set the new password
+	ok, err := a.DB.ResetPassword(tokenHash, user.PasswordHash)
+	if err != nil {
+		http.Error(w, "Error resetting password: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// normalizeEmail checks that the string is a single bare email address and returns it without
+// surrounding whitespace.
+func normalizeEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", err
+	}
+	if address.Name != "" || address.Address != strings.TrimSpace(email) {
+		return "", errors.New("not a bare email address")
+	}
+	return address.Address, nil
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// accessTokenTTL is how long an access token is valid. Access tokens are short-lived so that a
+	// revoked session stops working quickly even for clients that cache them.
+	accessTokenTTL = 15 * time.Minute
+
+	// refreshTokenTTL is how long a refresh token can be exchanged for new tokens. Every exchange
+	// rotates the refresh token, so an active session never expires.
+	refreshTokenTTL = 14 * 24 * time.Hour
+)
+
+type contextKey int
+
+const (
+	sessionIDKey contextKey = iota
+	userIDKey
+	organizationIDKey
+	roleKey
+	redactionKey
+)
+
+// withSessionID returns a copy of the context that carries the session ID of the request's token.
+func withSessionID(ctx context.Context, sessionID int) context.Context {
+	return context.WithValue(ctx, sessionIDKey, sessionID)
+}
+
+// sessionIDFromContext returns the session ID stored by AuthMiddleware, or 0 if there is none.
+func sessionIDFromContext(ctx context.Context) int {
+	sessionID, _ := ctx.Value(sessionIDKey).(int)
+	return sessionID
+}
+
+// withUserID returns a copy of the context that carries the user ID of the request's token.
+func withUserID(ctx context.Context, userID int) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
+// UserIDFromContext returns the ID of the user whose token authenticated the request, as stored by
+// AuthMiddleware, or 0 if there is none. Unlike the username, the ID never changes.
+func UserIDFromContext(ctx context.Context) int {
+	userID, _ := ctx.Value(userIDKey).(int)
+	return userID
+}
+
+// HandleRefresh exchanges a refresh token for a new access token and a new refresh token. Each
+// refresh token can only be used once. If a used refresh token is presented again, the token was
+// copied and the whole session is revoked.
+func (a *AuthService) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the request body
+	w.Header().Set("Content-Type", "application/json")
+	var reqBody struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil || reqBody.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Mark the refresh token as used
+	refreshTokenHash := hashToken(reqBody.RefreshToken)
+	sessionID, userID, username, err := a.DB.UseRefreshToken(refreshTokenHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			_, err = a.DB.RevokeSessionOfUsedRefreshToken(refreshTokenHash)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Error revoking session"})
+				return
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid refresh token"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error using refresh token"})
+		return
+	}
+
+	// Issue the next refresh token of the session
+	refreshToken, refreshTokenHash, err := newRefreshToken()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error creating token"})
+		return
+	}
+	err = a.DB.AddRefreshToken(sessionID, refreshTokenHash, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error creating token"})
+		return
+	}
+
+	a.respondWithTokens(userID, username, sessionID, refreshToken, w)
+}
+
+// HandleLogout revokes the session of the token the request was made with.
+func (a *AuthService) HandleLogout(w http.ResponseWriter, r *http.Request, username string) {
+	err := a.DB.RevokeSession(sessionIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error revoking session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleLogoutAll revokes every session of the user, including the current one, and their personal
+// access tokens.
+func (a *AuthService) HandleLogoutAll(w http.ResponseWriter, r *http.Request, username string) {
+	err := a.DB.RevokeUserSessions(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error revoking sessions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// startSession creates a new session for the user and returns its ID and first refresh token.
+func (a *AuthService) startSession(userID int) (int, string, error) {
+	refreshToken, refreshTokenHash, err := newRefreshToken()
+	if err != nil {
+		return 0, "", err
+	}
+	sessionID, err := a.DB.CreateSession(userID, refreshTokenHash, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return 0, "", err
+	}
+	return sessionID, refreshToken, nil
+}
+
+// newRefreshToken generates a random refresh token. It returns the token, which is only ever sent
+// to the client, and its hash, which is what gets stored.
+func newRefreshToken() (string, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return token, hashToken(token), nil
+}
+
+// randomToken returns 32 random bytes encoded as URL-safe base64.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewShareToken returns a new random token for a share link and the hash it is stored by.
+func NewShareToken() (string, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	return token, hashToken(token), nil
+}
+
+// HashShareToken returns the hash a share link's token is stored by.
+func HashShareToken(token string) string {
+	return hashToken(token)
+}
+
+// hashToken returns the hex encoded SHA-256 hash of a token. Tokens are random and long enough
+// that a fast hash is sufficient to make stored hashes useless to an attacker.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// throttle limits the attempts of one kind for a key, such as the failed logins of a username. The
+// first few attempts within the window are free. Every further attempt has to wait twice as long
+// after the previous one as the one before it, up to maxDelay, and once lockoutAfter attempts have
+// been made the key is locked out for the lockout duration.
+type throttle struct {
+	kind         string
+	window       time.Duration
+	freeAttempts int
+	maxDelay     time.Duration
+	lockoutAfter int
+	lockout      time.Duration
+}
+
+var (
+	// usernameThrottle limits failed logins of a username, which guards against guessing the
+	// password of one account.
+	usernameThrottle = throttle{
+		kind:         "username",
+		window:       15 * time.Minute,
+		freeAttempts: 3,
+		maxDelay:     30 * time.Second,
+		lockoutAfter: 10,
+		lockout:      15 * time.Minute,
+	}
+
+	// ipThrottle limits failed logins from an IP address, which guards against trying a common
+	// password against many accounts.
+	ipThrottle = throttle{
+		kind:         "ip",
+		window:       15 * time.Minute,
+		freeAttempts: 10,
+		maxDelay:     30 * time.Second,
+		lockoutAfter: 50,
+		lockout:      15 * time.Minute,
+	}
+
+	// signupThrottle limits signups from an IP address, successful or not.
+	signupThrottle = throttle{
+		kind:         "signup",
+		window:       time.Hour,
+		freeAttempts: 5,
+		maxDelay:     time.Minute,
+		lockoutAfter: 20,
+		lockout:      time.Hour,
+	}
+
+	// resetEmailThrottle limits password reset requests for an email address, which guards against
+	// flooding someone's inbox with reset emails.
+	resetEmailThrottle = throttle{
+		kind:         "reset-email",
+		window:       time.Hour,
+		freeAttempts: 3,
+		maxDelay:     15 * time.Minute,
+		lockoutAfter: 5,
+		lockout:      time.Hour,
+	}
+
+	// resetIPThrottle limits password reset requests from an IP address, which guards against
+	// burning the SMTP quota with requests for many addresses.
+	resetIPThrottle = throttle{
+		kind:         "reset-ip",
+		window:       time.Hour,
+		freeAttempts: 10,
+		maxDelay:     time.Minute,
+		lockoutAfter: 30,
+		lockout:      time.Hour,
+	}
+)
+
+// lockedUntil returns when the next attempt is allowed after the given number of attempts, the
+// last of which was made at the given time.
+func (t throttle) lockedUntil(attempts int, last time.Time) time.Time {
+	if attempts >= t.lockoutAfter {
+		return last.Add(t.lockout)
+	}
+	if attempts < t.freeAttempts {
+		return time.Time{}
+	}
+	delay := t.maxDelay
+	if shift := attempts - t.freeAttempts; shift < 16 {
+		delay = min(time.Second<<shift, t.maxDelay)
+	}
+	return last.Add(delay)
+}
+
+// reserveAttempts records an attempt for the keys of the throttles before it is made, unless one
+// of them is locked, in which case nothing is recorded and it returns when the next attempt is
+// allowed. Each key is checked and recorded atomically, so a burst of concurrent attempts counts
+// every one of them. It returns the IDs of the recorded attempts, which releaseAttempts forgets if
+// the attempt succeeds. Empty keys are skipped.
+func (a *AuthService) reserveAttempts(keys map[throttle]string) ([]int, time.Time, error) {
+	now := time.Now()
+	var ids []int
+	var until time.Time
+	for t, key := range keys {
+		if key == "" {
+			continue
+		}
+		id, err := a.DB.ReserveAuthAttempt(
+			t.kind,
+			key,
+			now,
+			now.Add(-t.window),
+			now.Add(-t.window-t.lockout),
+			func(attempts int, last time.Time) bool {
+				lockedUntil := t.lockedUntil(attempts, last)
+				if !lockedUntil.After(now) {
+					return true
+				}
+				if lockedUntil.After(until) {
+					until = lockedUntil
+				}
+				return false
+			},
+		)
+		if err != nil {
+			a.releaseAttempts(ids)
+			return nil, time.Time{}, err
+		}
+		if id != 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	if !until.IsZero() {
+		return nil, until, a.releaseAttempts(ids)
+	}
+	return ids, time.Time{}, nil
+}
+
+// releaseAttempts forgets attempts recorded by reserveAttempts, once they turned out to succeed.
+func (a *AuthService) releaseAttempts(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return a.DB.DeleteAuthAttempts(ids)
+}
+
+// respondThrottled tells the client when it can try again. The response is the same for every
+// throttle, so it doesn't reveal whether an account exists.
+func respondThrottled(w http.ResponseWriter, until time.Time) {
+	retryAfter := int(time.Until(until).Seconds()) + 1
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":        "Too many attempts, try again later",
+		"locked_until": until.UTC().Format(time.RFC3339),
+		"retry_after":  retryAfter,
+	})
+}
+
+// clientIP returns the IP address of the client that made the request. Behind a proxy, the
+// address is read from the header named by CLIENT_IP_HEADER, such as Fly-Client-IP on Fly.io.
+func clientIP(r *http.Request) string {
+	if header := os.Getenv("CLIENT_IP_HEADER"); header != "" {
+		if ip := r.Header.Get(header); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleLockedUntil(t *testing.T) {
+	th := throttle{
+		window:       15 * time.Minute,
+		freeAttempts: 3,
+		maxDelay:     30 * time.Second,
+		lockoutAfter: 10,
+		lockout:      15 * time.Minute,
+	}
+	last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		attempts int
+		want     time.Time
+	}{
+		{0, time.Time{}},
+		{2, time.Time{}},
+		{3, last.Add(time.Second)},
+		{4, last.Add(2 * time.Second)},
+		{7, last.Add(16 * time.Second)},
+		{8, last.Add(30 * time.Second)},
+		{9, last.Add(30 * time.Second)},
+		{10, last.Add(15 * time.Minute)},
+		{50, last.Add(15 * time.Minute)},
+	}
+	for _, test := range tests {
+		got := th.lockedUntil(test.attempts, last)
+		if !got.Equal(test.want) {
+			t.Errorf("lockedUntil(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
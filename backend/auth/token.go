@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"backend/models"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The scopes of personal access tokens. A token may only call the routes that accept one of its
+// scopes, while ScopeAdmin gives it the same access as a logged in user.
+const (
+	ScopeFleetRead     = "fleet:read"
+	ScopeSettingsWrite = "settings:write"
+	ScopeAdmin         = "admin"
+)
+
+// accessTokenPrefix starts every personal access token, which tells them apart from JWTs and makes
+// leaked tokens easy to find with secret scanners.
+const accessTokenPrefix = "tsg_"
+
+// HandleGetAccessTokens lists the user's personal access tokens without the tokens themselves.
+func (a *AuthService) HandleGetAccessTokens(w http.ResponseWriter, r *http.Request, username string) {
+	tokens, err := a.DB.GetAccessTokens(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching tokens: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// HandleCreateAccessToken creates a named personal access token with the requested scopes, which
+// expires after the given number of days or never if none are given. The token is only part of this
+// response, only its hash is stored.
+func (a *AuthService) HandleCreateAccessToken(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Name == "" || len(reqBody.Name) > 255 {
+		http.Error(w, "Name must be between 1 and 255 characters long", http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range reqBody.Scopes {
+		if scope != ScopeFleetRead && scope != ScopeSettingsWrite && scope != ScopeAdmin {
+			http.Error(w, "Unknown scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	if reqBody.ExpiresInDays < 0 {
+		http.Error(w, "Invalid expires_in_days", http.StatusBadRequest)
+		return
+	}
+
+	// Create the token
+	secret, err := randomToken()
+	if err != nil {
+		http.Error(w, "Error creating token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tokenString := accessTokenPrefix + secret
+	slices.Sort(reqBody.Scopes)
+	token := models.AccessToken{
+		UserID:    UserIDFromContext(r.Context()),
+		Name:      reqBody.Name,
+		Scopes:    slices.Compact(reqBody.Scopes),
+		CreatedAt: time.Now(),
+	}
+	if reqBody.ExpiresInDays > 0 {
+		expiresAt := token.CreatedAt.AddDate(0, 0, reqBody.ExpiresInDays)
+		token.ExpiresAt = &expiresAt
+	}
+	token.ID, err = a.DB.AddAccessToken(token, hashToken(tokenString))
+	if err != nil {
+		http.Error(w, "Error storing token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		models.AccessToken
+		Token string `json:"token"`
+	}{token, tokenString})
+}
+
+// HandleDeleteAccessToken revokes one of the user's personal access tokens, the one in the
+// /api/v1/tokens/{id} path or, on the deprecated route, the one in the request body.
+func (a *AuthService) HandleDeleteAccessToken(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request
+	var reqBody struct {
+		ID int `json:"id"`
+	}
+	var err error
+	if r.PathValue("id") != "" {
+		reqBody.ID, err = strconv.Atoi(r.PathValue("id"))
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+	}
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := a.DB.DeleteAccessToken(UserIDFromContext(r.Context()), reqBody.ID)
+	if err != nil {
+		http.Error(w, "Error deleting token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// isAccessToken reports whether the bearer token of a request is a personal access token.
+func isAccessToken(tokenString string) bool {
+	return strings.HasPrefix(tokenString, accessTokenPrefix)
+}
+
+// hasScope reports whether a personal access token with the scopes may call a route that accepts
+// the given scope.
+func hasScope(scopes []string, scope string) bool {
+	return slices.Contains(scopes, scope) || slices.Contains(scopes, ScopeAdmin)
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsAccessToken(t *testing.T) {
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"tsg_abc", true},
+		{"tsg_", true},
+		{"eyJhbGciOiJIUzI1NiJ9.e30.sig", false},
+		{"TSG_abc", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isAccessToken(test.token); got != test.want {
+			t.Errorf("isAccessToken(%q) = %v, want %v", test.token, got, test.want)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{"matching scope", []string{ScopeFleetRead}, ScopeFleetRead, true},
+		{"other scope", []string{ScopeFleetRead}, ScopeSettingsWrite, false},
+		{"one of several scopes", []string{ScopeFleetRead, ScopeSettingsWrite}, ScopeSettingsWrite, true},
+		{"admin scope", []string{ScopeAdmin}, ScopeSettingsWrite, true},
+		{"admin route", []string{ScopeFleetRead, ScopeSettingsWrite}, ScopeAdmin, false},
+		{"no scopes", nil, ScopeFleetRead, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := hasScope(test.scopes, test.scope); got != test.want {
+				t.Errorf("hasScope(%v, %q) = %v, want %v", test.scopes, test.scope, got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleCreateAccessTokenValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `{`},
+		{"no name", `{"scopes":["fleet:read"]}`},
+		{"long name", `{"name":"` + strings.Repeat("a", 256) + `","scopes":["fleet:read"]}`},
+		{"no scopes", `{"name":"ci"}`},
+		{"unknown scope", `{"name":"ci","scopes":["fleet:write"]}`},
+		{"negative expiry", `{"name":"ci","scopes":["fleet:read"],"expires_in_days":-1}`},
+	}
+	// The requests are rejected before the database is used
+	a := &AuthService{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/tokens", strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			a.HandleCreateAccessToken(w, r, "alice")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestScopedAuthMiddlewareMissingToken(t *testing.T) {
+	a := &AuthService{}
+	handler := a.SessionAuthMiddleware(func(w http.ResponseWriter, r *http.Request, username string) {
+		t.Error("handler called without a token")
+	})
+	for _, header := range []string{"", "Bearer ", "Basic dXNlcjpwYXNz", "tsg_abc"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/tokens", nil)
+		r.Header.Set("Authorization", header)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status = %d, want %d", header, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	tests := []struct {
+		name      string
+		sessionID int
+		want      int
+	}{
+		{"login session", 3, http.StatusOK},
+		{"personal access token", 0, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := requireSession(func(w http.ResponseWriter, r *http.Request, username string) {
+				w.WriteHeader(http.StatusOK)
+			})
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/tokens", nil)
+			r = r.WithContext(withSessionID(withUserID(r.Context(), 1), test.sessionID))
+			w := httptest.NewRecorder()
+			handler(w, r, "alice")
+			if w.Code != test.want {
+				t.Errorf("status = %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 test vectors, "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTP(t *testing.T) {
+	// The 8-digit codes of appendix B of RFC 6238 truncated to their last 6 digits, which is what
+	// the same HOTP value gives with 6 digits
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		unix   int64
+		ok     bool
+		step   int64
+	}{
+		{"rfc 6238 at 59", rfc6238Secret, "287082", 59, true, 1},
+		{"rfc 6238 at 1111111109", rfc6238Secret, "081804", 1111111109, true, 37037036},
+		{"rfc 6238 at 1111111111", rfc6238Secret, "050471", 1111111111, true, 37037037},
+		{"rfc 6238 at 1234567890", rfc6238Secret, "005924", 1234567890, true, 41152263},
+		{"rfc 6238 at 2000000000", rfc6238Secret, "279037", 2000000000, true, 66666666},
+		{"rfc 6238 at 20000000000", rfc6238Secret, "353130", 20000000000, true, 666666666},
+		{"lower case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", 59, true, 1},
+		{"surrounding spaces", rfc6238Secret, " 287082 ", 59, true, 1},
+		{"previous step", rfc6238Secret, "287082", 59 + totpPeriod, true, 1},
+		{"next step", rfc6238Secret, "287082", 59 - totpPeriod, true, 1},
+		{"two steps late", rfc6238Secret, "287082", 59 + 2*totpPeriod, false, 0},
+		{"wrong code", rfc6238Secret, "287083", 59, false, 0},
+		{"8 digits", rfc6238Secret, "94287082", 59, false, 0},
+		{"invalid secret", "not base32!", "287082", 59, false, 0},
+		{"empty secret", "", "287082", 59, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := validateTOTP(test.secret, test.code, time.Unix(test.unix, 0))
+			if ok != test.ok || step != test.step {
+				t.Errorf("validateTOTP() = %d, %v, want %d, %v", step, ok, test.step, test.ok)
+			}
+		})
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode("abcde-fghij")
+	for _, code := range []string{"ABCDE-FGHIJ", " abcdefghij ", "abcde fghij"} {
+		if got := hashRecoveryCode(code); got != want {
+			t.Errorf("hashRecoveryCode(%q) differs from the hash of abcde-fghij", code)
+		}
+	}
+	if hashRecoveryCode("abcde-fghik") == want {
+		t.Error("hashRecoveryCode() of another code is the same")
+	}
+}
@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"backend/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// recoveryCodeCount is the number of recovery codes generated when 2FA is enabled.
+	recoveryCodeCount = 10
+
+	// challengeTokenTTL is how long a user has to enter their code after their password.
+	challengeTokenTTL = 5 * time.Minute
+
+	// challengePurpose is the purpose claim of the challenge tokens of a two-step login.
+	challengePurpose = "2fa"
+)
+
+// HandleEnrollTOTP starts two-factor enrollment by generating a new TOTP secret for the user. The
+// response contains the secret and an otpauth:// URI to show as a QR code. 2FA is only enabled
+// once the user confirms a code through HandleConfirmTOTP.
+func (a *AuthService) HandleEnrollTOTP(w http.ResponseWriter, r *http.Request, username string) {
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dbUser.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Error generating secret: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = a.DB.SetPendingTOTPSecret(dbUser.ID, secret)
+	if err != nil {
+		http.Error(w, "Error saving secret: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI(dbUser.Username, secret),
+	})
+}
+
+// HandleConfirmTOTP enables two-factor authentication once the user proves their authenticator
+// works by sending a code generated from the pending secret. It responds with the recovery codes,
+// which are only ever shown this once.
+func (a *AuthService) HandleConfirmTOTP(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dbUser.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusBadRequest)
+		return
+	}
+
+	// Check the code against the pending secret
+	secret, err := a.DB.GetTOTPSecret(dbUser.ID)
+	if err != nil {
+		http.Error(w, "Error fetching secret: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if secret == "" {
+		http.Error(w, "Two-factor enrollment has not been started", http.StatusBadRequest)
+		return
+	}
+	ok, err := a.useTOTPCode(dbUser.ID, secret, reqBody.Code)
+	if err != nil {
+		http.Error(w, "Error verifying code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	// Generate the recovery codes and enable 2FA
+	recoveryCodes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		http.Error(w, "Error generating recovery codes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var recoveryCodeHashes []string
+	for _, code := range recoveryCodes {
+		recoveryCodeHashes = append(recoveryCodeHashes, hashRecoveryCode(code))
+	}
+	err = a.DB.EnableTOTP(dbUser.ID, recoveryCodeHashes)
+	if err != nil {
+		http.Error(w, "Error enabling two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Operation successful",
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// HandleDisableTOTP turns off two-factor authentication. The user has to re-authenticate with
+// both their password and a TOTP or recovery code, so a hijacked session alone cannot remove 2FA.
+func (a *AuthService) HandleDisableTOTP(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !dbUser.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	// Re-authenticate the user, throttled the same way as logins
+	attempts, ok := a.reserveReauthAttempt(w, r, dbUser.Username)
+	if !ok {
+		return
+	}
+	err = a.verifyPassword(dbUser.PasswordHash, reqBody.Password)
+	if err != nil {
+		failLoginAndRespond(w)
+		return
+	}
+	ok, err = a.verifySecondFactor(dbUser.ID, reqBody.Code, reqBody.RecoveryCode)
+	if err != nil {
+		http.Error(w, "Error verifying code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		failLoginAndRespond(w)
+		return
+	}
+	if !a.releaseReauthAttempt(w, attempts) {
+		return
+	}
+
+	err = a.DB.DisableTOTP(dbUser.ID)
+	if err != nil {
+		http.Error(w, "Error disabling two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleLoginTOTP completes a two-step login. It exchanges the challenge token returned by
+// HandleLogin and a TOTP or recovery code for the user's access and refresh tokens.
+func (a *AuthService) HandleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the request body
+	w.Header().Set("Content-Type", "application/json")
+	var reqBody struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify the challenge token
+	userID, username, err := a.verifyChallengeToken(reqBody.ChallengeToken)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid challenge token"})
+		return
+	}
+
+	// Throttle repeated failed codes the same way as failed passwords
+	throttles := map[throttle]string{
+		usernameThrottle: username,
+		ipThrottle:       clientIP(r),
+	}
+	attempts, until, err := a.reserveAttempts(throttles)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error recording login attempt"})
+		return
+	}
+	if !until.IsZero() {
+		respondThrottled(w, until)
+		return
+	}
+
+	// Verify the second factor
+	ok, err := a.verifySecondFactor(userID, reqBody.Code, reqBody.RecoveryCode)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error verifying code"})
+		return
+	}
+	if !ok {
+		failLoginAndRespond(w)
+		return
+	}
+
+	// Forget the failed logins of the username and create a token for the user
+	a.completeLoginAndRespond(attempts, userID, username, w)
+}
+
+// createChallengeAndRespond sends the challenge token for the second step of a login, after the
+// user's password has been verified.
+func (a *AuthService) createChallengeAndRespond(user *models.User, w http.ResponseWriter) {
+	challengeToken, err := a.createChallengeToken(user)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Error creating token"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":             "Two-factor authentication required",
+		"two_factor_required": true,
+		"challenge_token":     challengeToken,
+	})
+}
+
+// createChallengeToken creates the token that the user exchanges, along with their code, for the
+// tokens of a session on /login/2fa.
+func (a *AuthService) createChallengeToken(user *models.User) (string, error) {
+	return a.Keys.sign(jwt.MapClaims{
+		"username": user.Username,
+		"uid":      user.ID,
+		"purpose":  challengePurpose,
+		"exp":      time.Now().Add(challengeTokenTTL).Unix(),
+	})
+}
+
+// verifyChallengeToken verifies a challenge token and returns the user ID and username it was
+// issued for.
+func (a *AuthService) verifyChallengeToken(tokenString string) (int, string, error) {
+	claims, err := a.verifyPurposeToken(tokenString, challengePurpose)
+	if err != nil {
+		return 0, "", err
+	}
+	userID, ok := claims["uid"].(float64)
+	if !ok {
+		return 0, "", errors.New("uid claim not found")
+	}
+	username, ok := claims["username"].(string)
+	if !ok {
+		return 0, "", errors.New("username claim not found")
+	}
+	return int(userID), username, nil
+}
+
+// verifySecondFactor checks a TOTP code or, if no code is given, a recovery code for the user.
+// Both kinds of code are consumed, so neither can be replayed.
+func (a *AuthService) verifySecondFactor(userID int, code string, recoveryCode string) (bool, error) {
+	if code == "" {
+		if recoveryCode == "" {
+			return false, nil
+		}
+		return a.DB.UseRecoveryCode(userID, hashRecoveryCode(recoveryCode))
+	}
+
+	secret, err := a.DB.GetTOTPSecret(userID)
+	if err != nil {
+		return false, err
+	}
+	return a.useTOTPCode(userID, secret, code)
+}
+
+// useTOTPCode validates a TOTP code against the secret and records its time step as used.
+func (a *AuthService) useTOTPCode(userID int, secret string, code string) (bool, error) {
+	counter, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return a.DB.UseTOTPCounter(userID, counter)
+}
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// emailVerificationTTL is how long the link in a verification email can be used.
+	emailVerificationTTL = 24 * time.Hour
+
+	// emailVerificationPurpose is the purpose claim of the token in a verification link.
+	emailVerificationPurpose = "verify-email"
+
+	// verificationResendInterval is how long a user has to wait before another verification email
+	// is sent to them.
+	verificationResendInterval = 5 * time.Minute
+)
+
+// HandleVerifyEmail marks the user's email address as verified using the token from the link in a
+// verification email. The link stops working if the user changes their address in the meantime.
+func (a *AuthService) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Token string `json:"token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil || reqBody.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify the token
+	claims, err := a.verifyPurposeToken(reqBody.Token, emailVerificationPurpose)
+	if err != nil {
+		http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+	userID, _ := claims["uid"].(float64)
+	email, _ := claims["email"].(string)
+
+	// Mark the email address as verified
+	ok, err := a.DB.MarkEmailVerified(int(userID), email)
+	if err != nil {
+		http.Error(w, "Error verifying email address: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleResendVerification sends another verification email to the user's unverified email
+// address. Verification emails are sent at most once every verificationResendInterval.
+func (a *AuthService) HandleResendVerification(w http.ResponseWriter, r *http.Request, username string) {
+	// Fetch the user
+	dbUser, err := a.DB.GetUserByID(UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dbUser.Email == "" {
+		http.Error(w, "No email address to verify", http.StatusBadRequest)
+		return
+	}
+	if dbUser.EmailVerified {
+		http.Error(w, "Email address already verified", http.StatusBadRequest)
+		return
+	}
+
+	// Send the verification email
+	sent, err := a.sendVerificationEmail(dbUser.ID, dbUser.Username, dbUser.Email)
+	if err != nil {
+		http.Error(w, "Error sending verification email: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !sent {
+		http.Error(w, "Please wait before requesting another verification email", http.StatusTooManyRequests)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// sendVerificationEmail emails a signed verification link for the email address to the user. It
+// returns false without sending anything if the address is already verified or the previous
+// verification email was sent too recently. If another user has verified the address, its owner
+// is told instead that someone tried to add it, so adding an address doesn't reveal whether it is
+// registered.
+func (a *AuthService) sendVerificationEmail(userID int, username string, email string) (bool, error) {
+	ok, err := a.DB.ReserveVerificationEmail(userID, verificationResendInterval)
+	if err != nil || !ok {
+		return false, err
+	}
+	inUse, err := a.DB.EmailInUse(email, userID)
+	if err != nil {
+		return false, err
+	}
+	if inUse {
+		err = a.Mailer.Send(
+			email,
+			"Your TwoStepGPS email address",
+			"Hi,\n\n"+
+				"Someone tried to add this email address to another TwoStepGPS account. It stays "+
+				"with your account, and nothing else has changed.\n\n"+
+				"If you forgot your password, you can reset it from the login page.\n",
+		)
+		return err == nil, err
+	}
+
+	token, err := a.Keys.sign(jwt.MapClaims{
+		"purpose": emailVerificationPurpose,
+		"uid":     userID,
+		"email":   email,
+		"exp":     time.Now().Add(emailVerificationTTL).Unix(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	link := os.Getenv("EMAIL_VERIFICATION_URL") + "?" + url.Values{"token": {token}}.Encode()
+	err = a.Mailer.Send(
+		email,
+		"Verify your TwoStepGPS email address",
+		"Hi "+username+",\n\n"+
+			"Open the link below within a day to verify your email address:\n\n"+
+			link+"\n\n"+
+			"If you didn't add this address to a TwoStepGPS account, you can ignore this email.\n",
+	)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sendVerificationEmailInBackground sends a verification email without delaying the response.
+// Errors are logged, since the user can always ask for the email to be resent.
+func (a *AuthService) sendVerificationEmailInBackground(userID int, username string, email string) {
+	go func() {
+		_, err := a.sendVerificationEmail(userID, username, email)
+		if err != nil {
+			log.Printf("Error sending verification email: %v", err)
+		}
+	}()
+}
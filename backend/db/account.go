@@ -0,0 +1,60 @@
+package db
+
+// ChangePassword replaces the stored hash of the user's password. In the same transaction, every
+// session of the user except the given one is revoked, their personal access tokens are deleted
+// and unused password reset tokens are invalidated.
+func (d *DB) ChangePassword(userID int, passwordHash string, keepSessionID int) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET password_hash=$2 WHERE id=$1;", userID, passwordHash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND id<>$2 AND revoked_at IS NULL;",
+		userID,
+		keepSessionID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE password_reset_tokens SET used_at=now() WHERE user_id=$1 AND used_at IS NULL;",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM personal_access_tokens WHERE user_id=$1;", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteUser deletes the user and all of their data in one transaction. Recorded login attempts are
+// keyed by the username and are deleted explicitly, the rows of the user-owned tables are deleted by
+// their foreign keys.
+func (d *DB) DeleteUser(userID int, username string) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM auth_attempts WHERE kind='username' AND key=$1;", username)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM users WHERE id=$1;", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
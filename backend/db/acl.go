@@ -0,0 +1,251 @@
+package db
+
+// The device access control seed script:
+// ALTER TABLE organization_members ADD COLUMN restricted BOOLEAN NOT NULL DEFAULT false;
+// CREATE TABLE organization_groups (
+//     id SERIAL PRIMARY KEY,
+//     org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+//     name VARCHAR(255) NOT NULL
+// );
+// CREATE TABLE organization_group_members (
+//     group_id INTEGER NOT NULL REFERENCES organization_groups(id) ON DELETE CASCADE,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     PRIMARY KEY (group_id, user_id)
+// );
+// CREATE TABLE device_grants (
+//     id SERIAL PRIMARY KEY,
+//     org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+//     device_id VARCHAR(255) NOT NULL,
+//     user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+//     group_id INTEGER REFERENCES organization_groups(id) ON DELETE CASCADE,
+//     access VARCHAR(8) NOT NULL CHECK (access IN ('view', 'edit')),
+//     CHECK ((user_id IS NULL) <> (group_id IS NULL))
+// );
+
+import (
+	"backend/models"
+	"database/sql"
+)
+
+// GetDeviceAccess returns the devices a restricted member has been granted, directly or through
+// one of their groups, mapped to whether they may edit them. It returns a nil map if the member is
+// not restricted and has access to every device of the organization.
+func (d *DB) GetDeviceAccess(orgID int, userID int) (map[string]bool, error) {
+	var restricted bool
+	err := d.Conn.QueryRow(
+		"SELECT restricted FROM organization_members WHERE org_id=$1 AND user_id=$2;",
+		orgID,
+		userID,
+	).Scan(&restricted)
+	if err != nil {
+		return nil, err
+	}
+	if !restricted {
+		return nil, nil
+	}
+
+	rows, err := d.Conn.Query(
+		`SELECT device_id, bool_or(access = 'edit') FROM device_grants
+		WHERE org_id=$1 AND (user_id=$2 OR group_id IN (
+			SELECT group_id FROM organization_group_members WHERE user_id=$2
+		))
+		GROUP BY device_id;`,
+		orgID,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	access := make(map[string]bool)
+	for rows.Next() {
+		var deviceID string
+		var edit bool
+		err := rows.Scan(&deviceID, &edit)
+		if err != nil {
+			return nil, err
+		}
+		access[deviceID] = edit
+	}
+
+	return access, rows.Err()
+}
+
+// CreateGroup creates a group of members in the organization and returns its ID.
+func (d *DB) CreateGroup(orgID int, name string) (int, error) {
+	var id int
+	err := d.Conn.QueryRow(
+		"INSERT INTO organization_groups (org_id, name) VALUES ($1, $2) RETURNING id;",
+		orgID,
+		name,
+	).Scan(&id)
+	return id, err
+}
+
+// DeleteGroup deletes one of the organization's groups along with its grants. It returns false if
+// the organization has no group with the ID.
+func (d *DB) DeleteGroup(orgID int, groupID int) (bool, error) {
+	result, err := d.Conn.Exec(
+		"DELETE FROM organization_groups WHERE id=$1 AND org_id=$2;",
+		groupID,
+		orgID,
+	)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// GetGroups returns the organization's groups with the usernames of their members.
+func (d *DB) GetGroups(orgID int) ([]models.Group, error) {
+	rows, err := d.Conn.Query(
+		`SELECT organization_groups.id, organization_groups.name, users.username
+		FROM organization_groups
+		LEFT JOIN organization_group_members
+			ON organization_group_members.group_id = organization_groups.id
+		LEFT JOIN users ON users.id = organization_group_members.user_id
+		WHERE organization_groups.org_id=$1
+		ORDER BY organization_groups.id, users.username;`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []models.Group{}
+	for rows.Next() {
+		var id int
+		var name string
+		var username sql.NullString
+		err := rows.Scan(&id, &name, &username)
+		if err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].ID != id {
+			groups = append(groups, models.Group{ID: id, Name: name, Members: []string{}})
+		}
+		if username.Valid {
+			group := &groups[len(groups)-1]
+			group.Members = append(group.Members, username.String)
+		}
+	}
+
+	return groups, rows.Err()
+}
+
+// GroupExists reports whether the organization has a group with the ID.
+func (d *DB) GroupExists(orgID int, groupID int) (bool, error) {
+	var exists bool
+	err := d.Conn.QueryRow(
+		"SELECT exists (SELECT 1 FROM organization_groups WHERE id=$1 AND org_id=$2);",
+		groupID,
+		orgID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// AddGroupMember adds a member of the organization to one of its groups. It returns false if the
+// organization has no group with the ID.
+func (d *DB) AddGroupMember(orgID int, groupID int, userID int) (bool, error) {
+	exists, err := d.GroupExists(orgID, groupID)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	_, err = d.Conn.Exec(
+		`INSERT INTO organization_group_members (group_id, user_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;`,
+		groupID,
+		userID,
+	)
+	return err == nil, err
+}
+
+// RemoveGroupMember removes a user from one of the organization's groups. It returns false if the
+// user was not a member of the group.
+func (d *DB) RemoveGroupMember(orgID int, groupID int, userID int) (bool, error) {
+	result, err := d.Conn.Exec(
+		`DELETE FROM organization_group_members
+		WHERE user_id=$3 AND group_id IN (SELECT id FROM organization_groups WHERE id=$2 AND org_id=$1);`,
+		orgID,
+		groupID,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
+
+// AddDeviceGrant grants a member or a group of the organization access to a device and returns the
+// ID of the grant.
+func (d *DB) AddDeviceGrant(orgID int, grant models.DeviceGrant) (int, error) {
+	var id int
+	err := d.Conn.QueryRow(
+		`INSERT INTO device_grants (org_id, device_id, user_id, group_id, access)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id;`,
+		orgID,
+		grant.DeviceID,
+		grant.UserID,
+		grant.GroupID,
+		grant.Access,
+	).Scan(&id)
+	return id, err
+}
+
+// GetDeviceGrants returns the organization's device grants.
+func (d *DB) GetDeviceGrants(orgID int) ([]models.DeviceGrant, error) {
+	rows, err := d.Conn.Query(
+		`SELECT device_grants.id, device_grants.device_id, device_grants.user_id, users.username,
+			device_grants.group_id, device_grants.access
+		FROM device_grants LEFT JOIN users ON users.id = device_grants.user_id
+		WHERE device_grants.org_id=$1 ORDER BY device_grants.device_id, device_grants.id;`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []models.DeviceGrant{}
+	for rows.Next() {
+		var grant models.DeviceGrant
+		var userID, groupID sql.NullInt64
+		var username sql.NullString
+		err := rows.Scan(&grant.ID, &grant.DeviceID, &userID, &username, &groupID, &grant.Access)
+		if err != nil {
+			return nil, err
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			grant.UserID = &id
+			grant.Username = username.String
+		}
+		if groupID.Valid {
+			id := int(groupID.Int64)
+			grant.GroupID = &id
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, rows.Err()
+}
+
+// DeleteDeviceGrant revokes one of the organization's device grants. It returns false if the
+// organization has no grant with the ID.
+func (d *DB) DeleteDeviceGrant(orgID int, grantID int) (bool, error) {
+	result, err := d.Conn.Exec(
+		"DELETE FROM device_grants WHERE id=$1 AND org_id=$2;",
+		grantID,
+		orgID,
+	)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
@@ -0,0 +1,69 @@
+package db
+
+// The user credentials seed script:
+// ALTER TABLE users ADD COLUMN onestepgps_api_key TEXT NOT NULL DEFAULT '';
+
+// SetUserAPIKey stores the sealed OneStepGPS API key of the user's own fleet. An empty key removes
+// it.
+func (d *DB) SetUserAPIKey(userID int, apiKey string) error {
+	_, err := d.Conn.Exec("UPDATE users SET onestepgps_api_key=$2 WHERE id=$1;", userID, apiKey)
+	return err
+}
+
+// GetUserAPIKey returns the sealed OneStepGPS API key of the user's own fleet, which is empty if
+// none has been set.
+func (d *DB) GetUserAPIKey(userID int) (string, error) {
+	var apiKey string
+	err := d.Conn.QueryRow("SELECT onestepgps_api_key FROM users WHERE id=$1;", userID).Scan(&apiKey)
+	return apiKey, err
+}
+
+// GetUserAPIKeys returns the sealed OneStepGPS API keys of all users that have one, by user ID.
+func (d *DB) GetUserAPIKeys() (map[int]string, error) {
+	return d.getAPIKeys("users")
+}
+
+// ReplaceUserAPIKey replaces the user's OneStepGPS API key if it is still the old one, so a key
+// registered in the meantime is not overwritten. It reports whether the key was replaced.
+func (d *DB) ReplaceUserAPIKey(userID int, oldAPIKey string, newAPIKey string) (bool, error) {
+	return d.replaceAPIKey("users", userID, oldAPIKey, newAPIKey)
+}
+
+// getAPIKeys returns the non-empty OneStepGPS API keys of the rows of the table, by ID.
+func (d *DB) getAPIKeys(table string) (map[int]string, error) {
+	rows, err := d.Conn.Query(
+		"SELECT id, onestepgps_api_key FROM " + table + " WHERE onestepgps_api_key <> '';",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	apiKeys := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var apiKey string
+		err := rows.Scan(&id, &apiKey)
+		if err != nil {
+			return nil, err
+		}
+		apiKeys[id] = apiKey
+	}
+
+	return apiKeys, rows.Err()
+}
+
+// replaceAPIKey replaces the OneStepGPS API key of the row of the table if it is still the old one.
+func (d *DB) replaceAPIKey(table string, id int, oldAPIKey string, newAPIKey string) (bool, error) {
+	result, err := d.Conn.Exec(
+		"UPDATE "+table+" SET onestepgps_api_key=$3 WHERE id=$1 AND onestepgps_api_key=$2;",
+		id,
+		oldAPIKey,
+		newAPIKey,
+	)
+	if err != nil {
+		return false, err
+	}
+	replaced, err := result.RowsAffected()
+	return replaced > 0, err
+}
@@ -4,12 +4,24 @@ package db
 // CREATE TABLE DeviceSettings (
 //     ID SERIAL PRIMARY KEY,
 //     DeviceID VARCHAR(255),
-//     Username VARCHAR(255),
-//     IsHidden BOOLEAN DEFAULT false,
+//     UserID INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     IsHidden BOOLEAN,
 //     Nickname VARCHAR(255),
 //     Color VARCHAR(255),
-//     CONSTRAINT unique_username_deviceid UNIQUE (Username, DeviceID)
+//     CONSTRAINT unique_userid_deviceid UNIQUE (UserID, DeviceID)
 // );
+//
+// The migration of DeviceSettings rows keyed by Username to UserID. Rows left behind by earlier
+// username changes belong to no user and are deleted:
+// BEGIN;
+// ALTER TABLE DeviceSettings ADD COLUMN UserID INTEGER REFERENCES users(id) ON DELETE CASCADE;
+// UPDATE DeviceSettings SET UserID = users.id FROM users WHERE users.username = DeviceSettings.Username;
+// DELETE FROM DeviceSettings WHERE UserID IS NULL;
+// ALTER TABLE DeviceSettings ALTER COLUMN UserID SET NOT NULL;
+// ALTER TABLE DeviceSettings DROP CONSTRAINT unique_username_deviceid;
+// ALTER TABLE DeviceSettings ADD CONSTRAINT unique_userid_deviceid UNIQUE (UserID, DeviceID);
+// ALTER TABLE DeviceSettings DROP COLUMN Username;
+// COMMIT;
 
 import (
 	"backend/models"
@@ -47,13 +59,16 @@ func NewDB() (*DB, error) {
 	return &DB{Conn: db}, nil
 }
 
-func (d *DB) CreateUser(user models.User) error {
-	_, err := d.Conn.Exec(
-		"INSERT INTO users (username, password_hash) VALUES ($1, $2);",
+// CreateUser inserts the user and returns the ID of the new row.
+func (d *DB) CreateUser(user models.User) (int, error) {
+	var id int
+	err := d.Conn.QueryRow(
+		"INSERT INTO users (username, password_hash, email) VALUES ($1, $2, NULLIF($3, '')) RETURNING id;",
 		user.Username,
 		user.PasswordHash,
-	)
-	return err
+		user.Email,
+	).Scan(&id)
+	return id, err
 }
 
 func (d *DB) UserExists(username string) (bool, error) {
@@ -72,38 +87,104 @@ func (d *DB) UserExists(username string) (bool, error) {
 	return exists, nil
 }
 
-func (d *DB) GetUserByUsername(username string) (*models.User, error) {
+// userColumns are the columns of the users table read into a models.User by scanUser.
+const userColumns = "users.id, users.username, users.password_hash, users.totp_enabled, users.email, " +
+	"users.email_verified"
+
+// scanUser reads a row of userColumns into a models.User.
+func scanUser(row *sql.Row) (*models.User, error) {
 	var user models.User
-	err := d.Conn.QueryRow(
-		"SELECT * FROM users WHERE username=$1;",
-		username,
-	).Scan(
+	var email sql.NullString
+	err := row.Scan(
 		&user.ID,
 		&user.Username,
 		&user.PasswordHash,
+		&user.TOTPEnabled,
+		&email,
+		&user.EmailVerified,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	user.Email = email.String
 	return &user, nil
 }
 
-func (d *DB) UpdateUsername(oldUsername string, newUsername string) error {
+func (d *DB) GetUserByUsername(username string) (*models.User, error) {
+	return scanUser(d.Conn.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE username=$1;",
+		username,
+	))
+}
+
+func (d *DB) GetUserByID(id int) (*models.User, error) {
+	return scanUser(d.Conn.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE id=$1;",
+		id,
+	))
+}
+
+// GetUserByEmail returns the user with the given email address, ignoring case. Several users can
+// have the same unverified address, so the user who verified it comes first, and otherwise the
+// one who signed up first.
+func (d *DB) GetUserByEmail(email string) (*models.User, error) {
+	return scanUser(d.Conn.QueryRow(
+		"SELECT "+userColumns+` FROM users WHERE lower(email)=lower($1)
+		ORDER BY email_verified DESC, id LIMIT 1;`,
+		email,
+	))
+}
+
+// EmailInUse reports whether another user than the given one has verified the email address.
+func (d *DB) EmailInUse(email string, userID int) (bool, error) {
+	var exists bool
+	err := d.Conn.QueryRow(
+		`SELECT exists (
+			SELECT 1 FROM users WHERE lower(email)=lower($1) AND email_verified AND id<>$2
+		);`,
+		email,
+		userID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// UpdateEmail sets the user's email address. An empty address removes it. If the address changes,
+// it has to be verified again.
+func (d *DB) UpdateEmail(userID int, email string) error {
+	_, err := d.Conn.Exec(
+		`UPDATE users SET
+			email=NULLIF($2, ''),
+			email_verified=COALESCE(email_verified AND lower(email)=lower($2), false),
+			email_verification_sent_at=CASE WHEN lower(email)=lower($2) THEN email_verification_sent_at END
+		WHERE id=$1;`,
+		userID,
+		email,
+	)
+	return err
+}
+
+// UpdatePasswordHash replaces the stored hash of the user's password.
+func (d *DB) UpdatePasswordHash(userID int, passwordHash string) error {
+	_, err := d.Conn.Exec("UPDATE users SET password_hash=$2 WHERE id=$1;", userID, passwordHash)
+	return err
+}
+
+func (d *DB) UpdateUsername(userID int, newUsername string) error {
 	_, err := d.Conn.Exec(
-		"UPDATE users SET username=$1 WHERE username=$2;",
+		"UPDATE users SET username=$1 WHERE id=$2;",
 		newUsername,
-		oldUsername,
+		userID,
 	)
 	return err
 }
 
 func (d *DB) AddDeviceSetting(device models.DeviceSettings) error {
 	_, err := d.Conn.Exec(
-		"INSERT INTO DeviceSettings (DeviceID, Username, IsHidden, Nickname, Color) VALUES ($1, $2, $3, $4, $5);",
+		"INSERT INTO DeviceSettings (DeviceID, UserID, IsHidden, Nickname, Color) VALUES ($1, $2, $3, $4, $5);",
 		device.DeviceID,
-		device.Username,
+		device.UserID,
 		false,
 		device.Nickname,
 		device.Color,
@@ -114,31 +195,31 @@ func (d *DB) AddDeviceSetting(device models.DeviceSettings) error {
 // HideDevice updates the visibility status of a device for a specific user.
 // It sets the IsHidden field in the DeviceSettings table to the provided value.
 // Parameters:
-//   - username: The username of the user.
+//   - userID: The ID of the user.
 //   - deviceID: The ID of the device.
 //   - hide: The visibility status to set for the device (true for hidden, false for visible).
 //
 // Returns:
 //   - error: An error if the update operation fails, nil otherwise.
-func (d *DB) HideDevice(username string, deviceID string, hide bool) error {
+func (d *DB) HideDevice(userID int, deviceID string, hide bool) error {
 	_, err := d.Conn.Exec(
-		`INSERT INTO DeviceSettings (Username, DeviceID, IsHidden) 
+		`INSERT INTO DeviceSettings (UserID, DeviceID, IsHidden) 
 		VALUES ($1, $2, $3)
-		ON CONFLICT (Username, DeviceID) 
+		ON CONFLICT (UserID, DeviceID) 
 		DO UPDATE SET IsHidden = $3;`,
-		username,
+		userID,
 		deviceID,
 		hide,
 	)
 	return err
 }
 
-// GetHiddenDevices retrieves the hidden devices for a given username from the database.
+// GetHiddenDevices retrieves the hidden devices for a given user from the database.
 // It returns a slice of device IDs and an error, if any.
-func (d *DB) GetHiddenDevices(username string) ([]string, error) {
+func (d *DB) GetHiddenDevices(userID int) ([]string, error) {
 	rows, err := d.Conn.Query(
-		"SELECT DeviceID FROM DeviceSettings WHERE Username=$1 AND IsHidden=true;",
-		username,
+		"SELECT DeviceID FROM DeviceSettings WHERE UserID=$1 AND IsHidden=true;",
+		userID,
 	)
 	if err != nil {
 		return nil, err
@@ -158,22 +239,63 @@ func (d *DB) GetHiddenDevices(username string) ([]string, error) {
 	return hiddenDeviceIDs, nil
 }
 
-func (d *DB) ChangeColor(username string, deviceID string, color string) error {
+func (d *DB) ChangeColor(userID int, deviceID string, color string) error {
 	_, err := d.Conn.Exec(
-		`INSERT INTO DeviceSettings (Username, DeviceID, Color) 
+		`INSERT INTO DeviceSettings (UserID, DeviceID, Color) 
 		VALUES ($1, $2, $3)
-		ON CONFLICT (Username, DeviceID) 
+		ON CONFLICT (UserID, DeviceID) 
 		DO UPDATE SET Color = $3;`,
-		username,
+		userID,
 		deviceID,
 		color,
 	)
 	return err
 }
 
-func (d *DB) GetDeviceSettings(username string) (map[string]models.DeviceSettings, error) {
-	// Fetch device settings for the user from the database
-	rows, err := d.Conn.Query("SELECT DeviceID, IsHidden, Color, Nickname FROM DeviceSettings WHERE Username = $1", username)
+// PatchDeviceSettings applies the patches to the user's device settings in one transaction.
+func (d *DB) PatchDeviceSettings(userID int, patches []models.DeviceSettingsPatch) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, patch := range patches {
+		_, err = tx.Exec(
+			`INSERT INTO DeviceSettings (UserID, DeviceID, IsHidden, Nickname, Color)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (UserID, DeviceID)
+			DO UPDATE SET IsHidden = COALESCE($3, DeviceSettings.IsHidden),
+				Nickname = COALESCE($4, DeviceSettings.Nickname),
+				Color = COALESCE($5, DeviceSettings.Color);`,
+			userID,
+			patch.DeviceID,
+			patch.IsHidden,
+			patch.Nickname,
+			patch.Color,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetDeviceSettings returns the user's settings for each device, keyed by device ID. Settings the
+// user has not set are taken from the defaults of the organization, if orgID is not 0, and
+// otherwise from the global defaults.
+func (d *DB) GetDeviceSettings(userID int, orgID int) (map[string]models.DeviceSettings, error) {
+	// Fetch device settings for the user and the organization from the database
+	rows, err := d.Conn.Query(
+		`SELECT COALESCE(u.DeviceID, o.device_id), COALESCE(u.IsHidden, o.is_hidden),
+			COALESCE(u.Color, o.color), COALESCE(u.Nickname, o.nickname)
+		FROM (SELECT * FROM DeviceSettings WHERE UserID = $1) u
+		FULL OUTER JOIN (SELECT * FROM organization_device_settings WHERE org_id = $2) o
+		ON u.DeviceID = o.device_id`,
+		userID,
+		orgID,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -215,13 +337,13 @@ func (d *DB) GetDeviceSettings(username string) (map[string]models.DeviceSetting
 	return deviceSettingsMap, nil
 }
 
-func (d *DB) ChangeNickname(username string, deviceID string, nickname string) error {
+func (d *DB) ChangeNickname(userID int, deviceID string, nickname string) error {
 	_, err := d.Conn.Exec(
-		`INSERT INTO DeviceSettings (Username, DeviceID, Nickname) 
+		`INSERT INTO DeviceSettings (UserID, DeviceID, Nickname) 
 		VALUES ($1, $2, $3)
-		ON CONFLICT (Username, DeviceID) 
+		ON CONFLICT (UserID, DeviceID) 
 		DO UPDATE SET Nickname = $3;`,
-		username,
+		userID,
 		deviceID,
 		nickname,
 	)
@@ -0,0 +1,276 @@
+package db
+
+// The device_groups, device_group_members and device_tags tables seed script. Groups and tags
+// belong either to a user, for their own fleet, or to an organization:
+// CREATE TABLE device_groups (
+//     id SERIAL PRIMARY KEY,
+//     user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+//     org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+//     name VARCHAR(255) NOT NULL,
+//     CHECK ((user_id IS NULL) <> (org_id IS NULL))
+// );
+// CREATE TABLE device_group_members (
+//     group_id INTEGER NOT NULL REFERENCES device_groups(id) ON DELETE CASCADE,
+//     device_id VARCHAR(255) NOT NULL,
+//     PRIMARY KEY (group_id, device_id)
+// );
+// CREATE TABLE device_tags (
+//     id SERIAL PRIMARY KEY,
+//     user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+//     org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+//     device_id VARCHAR(255) NOT NULL,
+//     tag VARCHAR(64) NOT NULL,
+//     CHECK ((user_id IS NULL) <> (org_id IS NULL))
+// );
+// CREATE UNIQUE INDEX device_tags_user ON device_tags (user_id, device_id, tag) WHERE user_id IS NOT NULL;
+// CREATE UNIQUE INDEX device_tags_org ON device_tags (org_id, device_id, tag) WHERE org_id IS NOT NULL;
+
+import (
+	"backend/models"
+	"database/sql"
+)
+
+// ownerColumn returns the column and value that select the rows of the organization if orgID is
+// not 0, and otherwise the user's own rows.
+func ownerColumn(userID int, orgID int) (string, int) {
+	if orgID != 0 {
+		return "org_id", orgID
+	}
+	return "user_id", userID
+}
+
+// CreateDeviceGroup creates a device group for the organization, or the user if orgID is 0, and
+// returns its ID.
+func (d *DB) CreateDeviceGroup(userID int, orgID int, name string) (int, error) {
+	column, owner := ownerColumn(userID, orgID)
+	var id int
+	err := d.Conn.QueryRow(
+		"INSERT INTO device_groups ("+column+", name) VALUES ($1, $2) RETURNING id;",
+		owner,
+		name,
+	).Scan(&id)
+	return id, err
+}
+
+// DeleteDeviceGroup deletes a device group of the organization, or the user if orgID is 0. It
+// returns false if there is no such group.
+func (d *DB) DeleteDeviceGroup(userID int, orgID int, groupID int) (bool, error) {
+	column, owner := ownerColumn(userID, orgID)
+	result, err := d.Conn.Exec(
+		"DELETE FROM device_groups WHERE id=$1 AND "+column+"=$2;",
+		groupID,
+		owner,
+	)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// GetDeviceGroups returns the device groups of the organization, or the user if orgID is 0, with
+// their devices.
+func (d *DB) GetDeviceGroups(userID int, orgID int) ([]models.DeviceGroup, error) {
+	column, owner := ownerColumn(userID, orgID)
+	rows, err := d.Conn.Query(
+		`SELECT device_groups.id, device_groups.name, device_group_members.device_id
+		FROM device_groups
+		LEFT JOIN device_group_members ON device_group_members.group_id = device_groups.id
+		WHERE device_groups.`+column+`=$1
+		ORDER BY device_groups.id, device_group_members.device_id;`,
+		owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []models.DeviceGroup{}
+	for rows.Next() {
+		var id int
+		var name string
+		var deviceID sql.NullString
+		err := rows.Scan(&id, &name, &deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || groups[len(groups)-1].ID != id {
+			groups = append(groups, models.DeviceGroup{ID: id, Name: name, DeviceIDs: []string{}})
+		}
+		if deviceID.Valid {
+			group := &groups[len(groups)-1]
+			group.DeviceIDs = append(group.DeviceIDs, deviceID.String)
+		}
+	}
+
+	return groups, rows.Err()
+}
+
+// GetDeviceGroupDevices returns the devices of a device group of the organization, or the user if
+// orgID is 0. It returns sql.ErrNoRows if there is no such group.
+func (d *DB) GetDeviceGroupDevices(userID int, orgID int, groupID int) ([]string, error) {
+	column, owner := ownerColumn(userID, orgID)
+	var exists bool
+	err := d.Conn.QueryRow(
+		"SELECT exists (SELECT 1 FROM device_groups WHERE id=$1 AND "+column+"=$2);",
+		groupID,
+		owner,
+	).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := d.Conn.Query(
+		"SELECT device_id FROM device_group_members WHERE group_id=$1 ORDER BY device_id;",
+		groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deviceIDs := []string{}
+	for rows.Next() {
+		var deviceID string
+		err := rows.Scan(&deviceID)
+		if err != nil {
+			return nil, err
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	return deviceIDs, rows.Err()
+}
+
+// UpdateDeviceGroup adds devices to and removes devices from a device group of the organization, or
+// the user if orgID is 0, in one transaction. It returns false if there is no such group.
+func (d *DB) UpdateDeviceGroup(userID int, orgID int, groupID int, add []string, remove []string) (bool, error) {
+	column, owner := ownerColumn(userID, orgID)
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(
+		"SELECT exists (SELECT 1 FROM device_groups WHERE id=$1 AND "+column+"=$2);",
+		groupID,
+		owner,
+	).Scan(&exists)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	for _, deviceID := range add {
+		_, err = tx.Exec(
+			`INSERT INTO device_group_members (group_id, device_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING;`,
+			groupID,
+			deviceID,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, deviceID := range remove {
+		_, err = tx.Exec(
+			"DELETE FROM device_group_members WHERE group_id=$1 AND device_id=$2;",
+			groupID,
+			deviceID,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+// GetDeviceTags returns the tags of the devices of the organization, or the user if orgID is 0,
+// keyed by device ID.
+func (d *DB) GetDeviceTags(userID int, orgID int) (map[string][]string, error) {
+	column, owner := ownerColumn(userID, orgID)
+	rows, err := d.Conn.Query(
+		"SELECT device_id, tag FROM device_tags WHERE "+column+"=$1 ORDER BY device_id, tag;",
+		owner,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var deviceID, tag string
+		err := rows.Scan(&deviceID, &tag)
+		if err != nil {
+			return nil, err
+		}
+		tags[deviceID] = append(tags[deviceID], tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// SetDeviceTags replaces the tags of a device of the organization, or the user if orgID is 0.
+func (d *DB) SetDeviceTags(userID int, orgID int, deviceID string, tags []string) error {
+	column, owner := ownerColumn(userID, orgID)
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"DELETE FROM device_tags WHERE "+column+"=$1 AND device_id=$2;",
+		owner,
+		deviceID,
+	)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = tx.Exec(
+			"INSERT INTO device_tags ("+column+", device_id, tag) VALUES ($1, $2, $3);",
+			owner,
+			deviceID,
+			tag,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetTaggedDevices returns the devices of the organization, or the user if orgID is 0, that have
+// the tag.
+func (d *DB) GetTaggedDevices(userID int, orgID int, tag string) ([]string, error) {
+	column, owner := ownerColumn(userID, orgID)
+	rows, err := d.Conn.Query(
+		"SELECT device_id FROM device_tags WHERE "+column+"=$1 AND tag=$2 ORDER BY device_id;",
+		owner,
+		tag,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deviceIDs := []string{}
+	for rows.Next() {
+		var deviceID string
+		err := rows.Scan(&deviceID)
+		if err != nil {
+			return nil, err
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	return deviceIDs, rows.Err()
+}
@@ -0,0 +1,67 @@
+package db
+
+// The oidc_identities table seed script:
+// CREATE TABLE oidc_identities (
+//     issuer VARCHAR(255) NOT NULL,
+//     subject VARCHAR(255) NOT NULL,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//     PRIMARY KEY (issuer, subject)
+// );
+
+import "backend/models"
+
+// GetUserByOIDCIdentity returns the user linked to the subject of an OpenID Connect issuer. It
+// returns sql.ErrNoRows if no user is linked.
+func (d *DB) GetUserByOIDCIdentity(issuer string, subject string) (*models.User, error) {
+	return scanUser(d.Conn.QueryRow(
+		`SELECT `+userColumns+`
+		FROM users JOIN oidc_identities ON oidc_identities.user_id = users.id
+		WHERE oidc_identities.issuer=$1 AND oidc_identities.subject=$2;`,
+		issuer,
+		subject,
+	))
+}
+
+// LinkOIDCIdentity links the subject of an OpenID Connect issuer to an existing user.
+func (d *DB) LinkOIDCIdentity(userID int, issuer string, subject string) error {
+	_, err := d.Conn.Exec(
+		"INSERT INTO oidc_identities (issuer, subject, user_id) VALUES ($1, $2, $3);",
+		issuer,
+		subject,
+		userID,
+	)
+	return err
+}
+
+// CreateOIDCUser creates a user without a password and links it to the subject of an OpenID
+// Connect issuer in one transaction. It returns the ID of the new user.
+func (d *DB) CreateOIDCUser(username string, issuer string, subject string) (int, error) {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// An empty password hash never matches a password, so the user can only log in through SSO
+	var userID int
+	err = tx.QueryRow(
+		"INSERT INTO users (username, password_hash) VALUES ($1, '') RETURNING id;",
+		username,
+	).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO oidc_identities (issuer, subject, user_id) VALUES ($1, $2, $3);",
+		issuer,
+		subject,
+		userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
@@ -0,0 +1,333 @@
+package db
+
+// The organizations seed script:
+// CREATE TABLE organizations (
+//     id SERIAL PRIMARY KEY,
+//     name VARCHAR(255) NOT NULL,
+//     onestepgps_api_key TEXT NOT NULL DEFAULT '',
+//     created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+// );
+// CREATE TABLE organization_members (
+//     org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     role VARCHAR(16) NOT NULL CHECK (role IN ('owner', 'admin', 'dispatcher', 'viewer')),
+//     PRIMARY KEY (org_id, user_id)
+// );
+// CREATE TABLE organization_device_settings (
+//     org_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+//     device_id VARCHAR(255) NOT NULL,
+//     is_hidden BOOLEAN,
+//     nickname VARCHAR(255),
+//     color VARCHAR(255),
+//     PRIMARY KEY (org_id, device_id)
+// );
+//
+// Organizations' API keys are sealed by secrets.Box. Keys stored before they were encrypted are
+// sealed on startup by DeviceService.ResealCredentials.
+//
+// Members' own settings only override the organization's defaults where they are set, so a
+// DeviceSettings row created by changing a color must not set IsHidden:
+// ALTER TABLE DeviceSettings ALTER COLUMN IsHidden DROP DEFAULT;
+
+import (
+	"backend/models"
+	"database/sql"
+)
+
+// CreateOrganization creates an organization with the user as its owner in one transaction and
+// returns the ID of the organization.
+func (d *DB) CreateOrganization(name string, ownerID int) (int, error) {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var orgID int
+	err = tx.QueryRow("INSERT INTO organizations (name) VALUES ($1) RETURNING id;", name).Scan(&orgID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, 'owner');",
+		orgID,
+		ownerID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return orgID, tx.Commit()
+}
+
+// GetOrganizations returns the organizations the user is a member of, with the user's role in each.
+func (d *DB) GetOrganizations(userID int) ([]models.Organization, error) {
+	rows, err := d.Conn.Query(
+		`SELECT organizations.id, organizations.name, organization_members.role,
+			organizations.onestepgps_api_key <> ''
+		FROM organizations
+		JOIN organization_members ON organization_members.org_id = organizations.id
+		WHERE organization_members.user_id=$1 ORDER BY organizations.id;`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	organizations := []models.Organization{}
+	for rows.Next() {
+		var organization models.Organization
+		err := rows.Scan(
+			&organization.ID,
+			&organization.Name,
+			&organization.Role,
+			&organization.HasCredentials,
+		)
+		if err != nil {
+			return nil, err
+		}
+		organizations = append(organizations, organization)
+	}
+
+	return organizations, rows.Err()
+}
+
+// GetMemberRole returns the user's role in the organization. It returns sql.ErrNoRows if the user
+// is not a member.
+func (d *DB) GetMemberRole(orgID int, userID int) (string, error) {
+	var role string
+	err := d.Conn.QueryRow(
+		"SELECT role FROM organization_members WHERE org_id=$1 AND user_id=$2;",
+		orgID,
+		userID,
+	).Scan(&role)
+	return role, err
+}
+
+// GetOnlyMembership returns the organization and role of a user that is a member of exactly one
+// organization. It returns sql.ErrNoRows if the user is a member of none or several.
+func (d *DB) GetOnlyMembership(userID int) (int, string, error) {
+	var orgID int
+	var role string
+	err := d.Conn.QueryRow(
+		`SELECT org_id, role FROM organization_members
+		WHERE user_id=$1 AND (SELECT count(*) FROM organization_members WHERE user_id=$1) = 1;`,
+		userID,
+	).Scan(&orgID, &role)
+	return orgID, role, err
+}
+
+// GetMembers returns the members of the organization.
+func (d *DB) GetMembers(orgID int) ([]models.Member, error) {
+	rows, err := d.Conn.Query(
+		`SELECT users.id, users.username, organization_members.role, organization_members.restricted
+		FROM organization_members JOIN users ON users.id = organization_members.user_id
+		WHERE organization_members.org_id=$1 ORDER BY users.username;`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.Member{}
+	for rows.Next() {
+		var member models.Member
+		err := rows.Scan(&member.UserID, &member.Username, &member.Role, &member.Restricted)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// SetMemberRole adds the user to the organization with the role, or changes their role if they are
+// already a member. If restricted is not nil, it also sets whether the member only has access to
+// the devices granted to them in the same statement, otherwise new members are unrestricted and
+// existing members keep their setting.
+func (d *DB) SetMemberRole(orgID int, userID int, role string, restricted *bool) error {
+	_, err := d.Conn.Exec(
+		`INSERT INTO organization_members (org_id, user_id, role, restricted)
+		VALUES ($1, $2, $3, COALESCE($4::boolean, false))
+		ON CONFLICT (org_id, user_id) DO UPDATE
+		SET role = $3, restricted = COALESCE($4::boolean, organization_members.restricted);`,
+		orgID,
+		userID,
+		role,
+		restricted,
+	)
+	return err
+}
+
+// RemoveMember removes the user from the organization. It returns false if the user was not a
+// member.
+func (d *DB) RemoveMember(orgID int, userID int) (bool, error) {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"DELETE FROM organization_members WHERE org_id=$1 AND user_id=$2;",
+		orgID,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+
+	// Group memberships and device grants don't outlive the membership
+	_, err = tx.Exec(
+		`DELETE FROM organization_group_members
+		WHERE user_id=$2 AND group_id IN (SELECT id FROM organization_groups WHERE org_id=$1);`,
+		orgID,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM device_grants WHERE org_id=$1 AND user_id=$2;", orgID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// CountOwners returns how many owners the organization has.
+func (d *DB) CountOwners(orgID int) (int, error) {
+	var count int
+	err := d.Conn.QueryRow(
+		"SELECT count(*) FROM organization_members WHERE org_id=$1 AND role='owner';",
+		orgID,
+	).Scan(&count)
+	return count, err
+}
+
+// GetSoleOwnedOrganizations returns the names of the organizations the user is the only owner of.
+func (d *DB) GetSoleOwnedOrganizations(userID int) ([]string, error) {
+	rows, err := d.Conn.Query(
+		`SELECT organizations.name
+		FROM organizations
+		JOIN organization_members ON organization_members.org_id = organizations.id
+		WHERE organization_members.user_id=$1 AND organization_members.role='owner'
+			AND (SELECT count(*) FROM organization_members owners
+				WHERE owners.org_id = organizations.id AND owners.role='owner') = 1
+		ORDER BY organizations.id;`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// SetOrganizationAPIKey stores the sealed OneStepGPS API key of the organization's fleet. An empty
+// key removes it.
+func (d *DB) SetOrganizationAPIKey(orgID int, apiKey string) error {
+	_, err := d.Conn.Exec(
+		"UPDATE organizations SET onestepgps_api_key=$2 WHERE id=$1;",
+		orgID,
+		apiKey,
+	)
+	return err
+}
+
+// GetOrganizationAPIKey returns the sealed OneStepGPS API key of the organization's fleet, which is
+// empty if none has been set.
+func (d *DB) GetOrganizationAPIKey(orgID int) (string, error) {
+	var apiKey string
+	err := d.Conn.QueryRow(
+		"SELECT onestepgps_api_key FROM organizations WHERE id=$1;",
+		orgID,
+	).Scan(&apiKey)
+	return apiKey, err
+}
+
+// GetOrganizationAPIKeys returns the sealed OneStepGPS API keys of all organizations that have one,
+// by organization ID.
+func (d *DB) GetOrganizationAPIKeys() (map[int]string, error) {
+	return d.getAPIKeys("organizations")
+}
+
+// ReplaceOrganizationAPIKey replaces the organization's OneStepGPS API key if it is still the old
+// one, so a key registered in the meantime is not overwritten. It reports whether the key was
+// replaced.
+func (d *DB) ReplaceOrganizationAPIKey(orgID int, oldAPIKey string, newAPIKey string) (bool, error) {
+	return d.replaceAPIKey("organizations", orgID, oldAPIKey, newAPIKey)
+}
+
+// SetDeviceDefaults sets the organization's default settings for a device. Nil fields keep their
+// current value.
+func (d *DB) SetDeviceDefaults(orgID int, defaults models.DeviceDefaults) error {
+	_, err := d.Conn.Exec(
+		`INSERT INTO organization_device_settings (org_id, device_id, is_hidden, nickname, color)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (org_id, device_id) DO UPDATE SET
+			is_hidden = COALESCE($3, organization_device_settings.is_hidden),
+			nickname = COALESCE($4, organization_device_settings.nickname),
+			color = COALESCE($5, organization_device_settings.color);`,
+		orgID,
+		defaults.DeviceID,
+		defaults.IsHidden,
+		defaults.Nickname,
+		defaults.Color,
+	)
+	return err
+}
+
+// GetDeviceDefaults returns the organization's default settings for its devices.
+func (d *DB) GetDeviceDefaults(orgID int) ([]models.DeviceDefaults, error) {
+	rows, err := d.Conn.Query(
+		`SELECT device_id, is_hidden, nickname, color
+		FROM organization_device_settings WHERE org_id=$1 ORDER BY device_id;`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	defaults := []models.DeviceDefaults{}
+	for rows.Next() {
+		var device models.DeviceDefaults
+		var isHidden sql.NullBool
+		var nickname, color sql.NullString
+		err := rows.Scan(&device.DeviceID, &isHidden, &nickname, &color)
+		if err != nil {
+			return nil, err
+		}
+		if isHidden.Valid {
+			device.IsHidden = &isHidden.Bool
+		}
+		if nickname.Valid {
+			device.Nickname = &nickname.String
+		}
+		if color.Valid {
+			device.Color = &color.String
+		}
+		defaults = append(defaults, device)
+	}
+
+	return defaults, rows.Err()
+}
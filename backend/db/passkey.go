@@ -0,0 +1,147 @@
+package db
+
+// The passkeys table seed script:
+// CREATE TABLE passkeys (
+//     id SERIAL PRIMARY KEY,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     name VARCHAR(255) NOT NULL,
+//     credential_id BYTEA NOT NULL UNIQUE,
+//     public_key BYTEA NOT NULL,
+//     attestation_type VARCHAR(255) NOT NULL,
+//     transports VARCHAR(255) NOT NULL DEFAULT '',
+//     sign_count BIGINT NOT NULL DEFAULT 0,
+//     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//     last_used_at TIMESTAMPTZ
+// );
+// CREATE TABLE used_passkey_challenges (
+//     challenge VARCHAR(255) PRIMARY KEY,
+//     expires_at TIMESTAMPTZ NOT NULL
+// );
+
+import (
+	"backend/models"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// AddPasskey stores a newly registered passkey.
+func (d *DB) AddPasskey(passkey models.Passkey) error {
+	_, err := d.Conn.Exec(
+		`INSERT INTO passkeys
+			(user_id, name, credential_id, public_key, attestation_type, transports, sign_count)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		passkey.UserID,
+		passkey.Name,
+		passkey.CredentialID,
+		passkey.PublicKey,
+		passkey.AttestationType,
+		strings.Join(passkey.Transports, ","),
+		int64(passkey.SignCount),
+	)
+	return err
+}
+
+// GetPasskeys returns the passkeys registered by the user, oldest first.
+func (d *DB) GetPasskeys(userID int) ([]models.Passkey, error) {
+	rows, err := d.Conn.Query(
+		`SELECT id, name, credential_id, public_key, attestation_type, transports, sign_count,
+			created_at, last_used_at
+		FROM passkeys WHERE user_id=$1 ORDER BY id;`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []models.Passkey{}
+	for rows.Next() {
+		passkey := models.Passkey{UserID: userID}
+		var transports string
+		var signCount int64
+		var lastUsedAt sql.NullTime
+		err := rows.Scan(
+			&passkey.ID,
+			&passkey.Name,
+			&passkey.CredentialID,
+			&passkey.PublicKey,
+			&passkey.AttestationType,
+			&transports,
+			&signCount,
+			&passkey.CreatedAt,
+			&lastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if transports != "" {
+			passkey.Transports = strings.Split(transports, ",")
+		}
+		passkey.SignCount = uint32(signCount)
+		if lastUsedAt.Valid {
+			passkey.LastUsedAt = &lastUsedAt.Time
+		}
+		passkeys = append(passkeys, passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// UpdatePasskeyUsage stores the sign counter reported by the authenticator during a login and
+// records when the passkey was last used.
+func (d *DB) UpdatePasskeyUsage(credentialID []byte, signCount uint32) error {
+	_, err := d.Conn.Exec(
+		"UPDATE passkeys SET sign_count=$2, last_used_at=now() WHERE credential_id=$1;",
+		credentialID,
+		int64(signCount),
+	)
+	return err
+}
+
+// DeletePasskey removes one of the user's passkeys. It returns false if the user has no passkey
+// with the given ID.
+func (d *DB) DeletePasskey(userID int, passkeyID int) (bool, error) {
+	result, err := d.Conn.Exec(
+		"DELETE FROM passkeys WHERE id=$1 AND user_id=$2;",
+		passkeyID,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// UsePasskeyChallenge records that the challenge of a passkey login was answered. It returns false
+// if it was already used. Challenges are kept until the given time, after which their login can't
+// be finished anyway, and expired ones are deleted.
+func (d *DB) UsePasskeyChallenge(challenge string, expiresAt time.Time) (bool, error) {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM used_passkey_challenges WHERE expires_at <= now();")
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.Exec(
+		`INSERT INTO used_passkey_challenges (challenge, expires_at) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;`,
+		challenge,
+		expiresAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return inserted > 0, tx.Commit()
+}
@@ -0,0 +1,96 @@
+package db
+
+// The password reset seed script:
+// ALTER TABLE users ADD COLUMN email VARCHAR(255);
+// CREATE UNIQUE INDEX users_email ON users (lower(email)) WHERE email_verified;
+// CREATE TABLE password_reset_tokens (
+//     token_hash VARCHAR(64) PRIMARY KEY,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//     expires_at TIMESTAMPTZ NOT NULL,
+//     used_at TIMESTAMPTZ
+// );
+//
+// The migration that lets several users add an address until one of them verifies it, so adding an
+// address doesn't reveal whether another user has it:
+// DROP INDEX users_email;
+// CREATE UNIQUE INDEX users_email ON users (lower(email)) WHERE email_verified;
+
+import (
+	"backend/models"
+	"database/sql"
+	"time"
+)
+
+// CreatePasswordResetToken stores the hash of a password reset token for the user.
+func (d *DB) CreatePasswordResetToken(userID int, tokenHash string, expiresAt time.Time) error {
+	_, err := d.Conn.Exec(
+		"INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3);",
+		tokenHash,
+		userID,
+		expiresAt,
+	)
+	return err
+}
+
+// GetPasswordResetUser returns the user a password reset token was issued for. It returns
+// sql.ErrNoRows if the token does not exist, has expired or was already used.
+func (d *DB) GetPasswordResetUser(tokenHash string) (*models.User, error) {
+	return scanUser(d.Conn.QueryRow(
+		`SELECT `+userColumns+`
+		FROM users JOIN password_reset_tokens ON password_reset_tokens.user_id = users.id
+		WHERE password_reset_tokens.token_hash=$1
+		AND password_reset_tokens.used_at IS NULL AND password_reset_tokens.expires_at > now();`,
+		tokenHash,
+	))
+}
+
+// ResetPassword uses a password reset token to set a new password hash for its user. In the same
+// transaction, every other reset token of the user is invalidated, all of the user's sessions
+// are revoked and their personal access tokens are deleted. It returns false if the token does not exist, has expired or was already used.
+func (d *DB) ResetPassword(tokenHash string, passwordHash string) (bool, error) {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(
+		`UPDATE password_reset_tokens SET used_at=now()
+		WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id;`,
+		tokenHash,
+	).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	_, err = tx.Exec("UPDATE users SET password_hash=$2 WHERE id=$1;", userID, passwordHash)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(
+		"UPDATE password_reset_tokens SET used_at=now() WHERE user_id=$1 AND used_at IS NULL;",
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(
+		"UPDATE sessions SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL;",
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM personal_access_tokens WHERE user_id=$1;", userID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
@@ -0,0 +1,154 @@
+package db
+
+// The sessions and refresh_tokens tables seed script:
+// CREATE TABLE sessions (
+//     id SERIAL PRIMARY KEY,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//     revoked_at TIMESTAMPTZ
+// );
+// CREATE TABLE refresh_tokens (
+//     token_hash VARCHAR(64) PRIMARY KEY,
+//     session_id INTEGER NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+//     expires_at TIMESTAMPTZ NOT NULL,
+//     used_at TIMESTAMPTZ
+// );
+// CREATE INDEX refresh_tokens_session_id ON refresh_tokens (session_id);
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CreateSession starts a new login session for the user and stores its first refresh token.
+// It returns the ID of the new session.
+func (d *DB) CreateSession(userID int, refreshTokenHash string, expiresAt time.Time) (int, error) {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var sessionID int
+	err = tx.QueryRow(
+		"INSERT INTO sessions (user_id) VALUES ($1) RETURNING id;",
+		userID,
+	).Scan(&sessionID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3);",
+		refreshTokenHash,
+		sessionID,
+		expiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return sessionID, tx.Commit()
+}
+
+// UseRefreshToken marks a refresh token as used and returns the session it belongs to along with
+// the session's user ID and username. It returns sql.ErrNoRows if the token does not exist, has
+// expired or was already used, or if its session was revoked.
+func (d *DB) UseRefreshToken(refreshTokenHash string) (int, int, string, error) {
+	var sessionID, userID int
+	var username string
+	err := d.Conn.QueryRow(
+		`UPDATE refresh_tokens SET used_at = now()
+		FROM sessions JOIN users ON users.id = sessions.user_id
+		WHERE refresh_tokens.token_hash = $1
+			AND refresh_tokens.session_id = sessions.id
+			AND refresh_tokens.used_at IS NULL
+			AND refresh_tokens.expires_at > now()
+			AND sessions.revoked_at IS NULL
+		RETURNING sessions.id, users.id, users.username;`,
+		refreshTokenHash,
+	).Scan(&sessionID, &userID, &username)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	return sessionID, userID, username, nil
+}
+
+// AddRefreshToken stores a new refresh token for an existing session.
+func (d *DB) AddRefreshToken(sessionID int, refreshTokenHash string, expiresAt time.Time) error {
+	_, err := d.Conn.Exec(
+		"INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3);",
+		refreshTokenHash,
+		sessionID,
+		expiresAt,
+	)
+	return err
+}
+
+// RevokeSessionOfUsedRefreshToken revokes the session of a refresh token that has already been
+// used. Presenting a used refresh token means it was copied, so the whole session is ended.
+// It returns true if a session was revoked.
+func (d *DB) RevokeSessionOfUsedRefreshToken(refreshTokenHash string) (bool, error) {
+	result, err := d.Conn.Exec(
+		`UPDATE sessions SET revoked_at = now()
+		WHERE revoked_at IS NULL AND id = (
+			SELECT session_id FROM refresh_tokens WHERE token_hash = $1 AND used_at IS NOT NULL
+		);`,
+		refreshTokenHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	revoked, err := result.RowsAffected()
+	return revoked > 0, err
+}
+
+// IsSessionActive reports whether the session exists and has not been revoked.
+func (d *DB) IsSessionActive(sessionID int) (bool, error) {
+	var active bool
+	err := d.Conn.QueryRow(
+		"SELECT revoked_at IS NULL FROM sessions WHERE id=$1;",
+		sessionID,
+	).Scan(&active)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return active, nil
+}
+
+// RevokeSession ends a single session. Access tokens of the session are rejected from then on and
+// its refresh tokens can no longer be used.
+func (d *DB) RevokeSession(sessionID int) error {
+	_, err := d.Conn.Exec(
+		"UPDATE sessions SET revoked_at = now() WHERE id=$1 AND revoked_at IS NULL;",
+		sessionID,
+	)
+	return err
+}
+
+// RevokeUserSessions ends every session of the user and deletes their personal access tokens in
+// one transaction.
+func (d *DB) RevokeUserSessions(userID int) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE sessions SET revoked_at = now() WHERE user_id=$1 AND revoked_at IS NULL;",
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM personal_access_tokens WHERE user_id=$1;", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,167 @@
+package db
+
+// The share_links table seed script:
+// CREATE TABLE share_links (
+//     id SERIAL PRIMARY KEY,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+//     name VARCHAR(255) NOT NULL,
+//     token_hash VARCHAR(64) NOT NULL UNIQUE,
+//     device_ids TEXT[] NOT NULL,
+//     window_start TIMESTAMPTZ,
+//     window_end TIMESTAMPTZ,
+//     expires_at TIMESTAMPTZ NOT NULL,
+//     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//     revoked_at TIMESTAMPTZ,
+//     view_count INTEGER NOT NULL DEFAULT 0,
+//     last_viewed_at TIMESTAMPTZ
+// );
+//
+// The migration of comma-separated device IDs to an array:
+// ALTER TABLE share_links ALTER COLUMN device_ids TYPE TEXT[] USING string_to_array(device_ids, ',');
+
+import (
+	"backend/models"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// shareLinkColumns are the columns scanShareLink reads, in order.
+const shareLinkColumns = `id, user_id, org_id, name, device_ids, window_start, window_end, expires_at,
+	created_at, revoked_at, view_count, last_viewed_at`
+
+// scanShareLink scans a row of shareLinkColumns into a share link.
+func scanShareLink(row interface{ Scan(...any) error }) (*models.ShareLink, error) {
+	var link models.ShareLink
+	var orgID sql.NullInt64
+	var windowStart, windowEnd, revokedAt, lastViewedAt sql.NullTime
+	err := row.Scan(
+		&link.ID,
+		&link.UserID,
+		&orgID,
+		&link.Name,
+		pq.Array(&link.DeviceIDs),
+		&windowStart,
+		&windowEnd,
+		&link.ExpiresAt,
+		&link.CreatedAt,
+		&revokedAt,
+		&link.ViewCount,
+		&lastViewedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if orgID.Valid {
+		id := int(orgID.Int64)
+		link.OrganizationID = &id
+	}
+	if windowStart.Valid {
+		link.WindowStart = &windowStart.Time
+	}
+	if windowEnd.Valid {
+		link.WindowEnd = &windowEnd.Time
+	}
+	if revokedAt.Valid {
+		link.RevokedAt = &revokedAt.Time
+	}
+	if lastViewedAt.Valid {
+		link.LastViewedAt = &lastViewedAt.Time
+	}
+	return &link, nil
+}
+
+// AddShareLink stores a new share link by the hash of its token and returns its ID.
+func (d *DB) AddShareLink(link models.ShareLink, tokenHash string) (int, error) {
+	var id int
+	err := d.Conn.QueryRow(
+		`INSERT INTO share_links (user_id, org_id, name, token_hash, device_ids, window_start,
+			window_end, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id;`,
+		link.UserID,
+		link.OrganizationID,
+		link.Name,
+		tokenHash,
+		pq.Array(link.DeviceIDs),
+		link.WindowStart,
+		link.WindowEnd,
+		link.ExpiresAt,
+	).Scan(&id)
+	return id, err
+}
+
+// GetShareLinks returns the share links the user created for the fleet of the organization, or
+// their own fleet if orgID is 0, newest first.
+func (d *DB) GetShareLinks(userID int, orgID int) ([]models.ShareLink, error) {
+	rows, err := d.Conn.Query(
+		"SELECT "+shareLinkColumns+` FROM share_links
+		WHERE user_id=$1 AND org_id IS NOT DISTINCT FROM NULLIF($2::integer, 0) ORDER BY id DESC;`,
+		userID,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, *link)
+	}
+
+	return links, rows.Err()
+}
+
+// GetActiveShareLink looks up an unexpired share link that has not been revoked by the hash of its
+// token. It returns sql.ErrNoRows if there is no such link.
+func (d *DB) GetActiveShareLink(tokenHash string) (*models.ShareLink, error) {
+	return scanShareLink(d.Conn.QueryRow(
+		"SELECT "+shareLinkColumns+` FROM share_links
+		WHERE token_hash=$1 AND revoked_at IS NULL AND expires_at > now();`,
+		tokenHash,
+	))
+}
+
+// RecordShareLinkViews counts views of share links in one transaction.
+func (d *DB) RecordShareLinkViews(views []models.ShareLinkViews) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, linkViews := range views {
+		_, err = tx.Exec(
+			`UPDATE share_links SET view_count = view_count + $2,
+			last_viewed_at = GREATEST(last_viewed_at, $3) WHERE id=$1;`,
+			linkViews.LinkID,
+			linkViews.Count,
+			linkViews.LastViewedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RevokeShareLink revokes one of the user's share links. It returns false if the user has no
+// active share link with the ID.
+func (d *DB) RevokeShareLink(userID int, linkID int) (bool, error) {
+	result, err := d.Conn.Exec(
+		"UPDATE share_links SET revoked_at = now() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL;",
+		linkID,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	revoked, err := result.RowsAffected()
+	return revoked > 0, err
+}
@@ -0,0 +1,94 @@
+package db
+
+// The auth_attempts table seed script:
+// CREATE TABLE auth_attempts (
+//     id SERIAL PRIMARY KEY,
+//     kind VARCHAR(16) NOT NULL,
+//     key TEXT NOT NULL,
+//     created_at TIMESTAMPTZ NOT NULL
+// );
+// CREATE INDEX auth_attempts_kind_key ON auth_attempts (kind, key, created_at);
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ReserveAuthAttempt records an attempt of the kind for the key if allow permits it, given how
+// many attempts were recorded since the given time and when the latest of them was made. Attempts
+// of the key made before forgetBefore are deleted, since they no longer count towards any limit.
+// Reservations of the same key are serialized, so concurrent attempts see each other. It returns
+// the ID of the recorded attempt, or 0 if allow refused it.
+func (d *DB) ReserveAuthAttempt(
+	kind string,
+	key string,
+	at time.Time,
+	since time.Time,
+	forgetBefore time.Time,
+	allow func(attempts int, last time.Time) bool,
+) (int, error) {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1 || ':' || $2));", kind, key)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		"DELETE FROM auth_attempts WHERE kind=$1 AND key=$2 AND created_at <= $3;",
+		kind,
+		key,
+		forgetBefore,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	var last *time.Time
+	err = tx.QueryRow(
+		"SELECT count(*), max(created_at) FROM auth_attempts WHERE kind=$1 AND key=$2 AND created_at > $3;",
+		kind,
+		key,
+		since,
+	).Scan(&count, &last)
+	if err != nil {
+		return 0, err
+	}
+	lastAt := time.Time{}
+	if last != nil {
+		lastAt = *last
+	}
+	if !allow(count, lastAt) {
+		return 0, tx.Commit()
+	}
+
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO auth_attempts (kind, key, created_at) VALUES ($1, $2, $3) RETURNING id;",
+		kind,
+		key,
+		at,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, tx.Commit()
+}
+
+// DeleteAuthAttempts deletes the recorded attempts with the given IDs.
+func (d *DB) DeleteAuthAttempts(ids []int) error {
+	_, err := d.Conn.Exec("DELETE FROM auth_attempts WHERE id = ANY($1);", pq.Array(ids))
+	return err
+}
+
+// ClearAuthAttempts deletes all recorded attempts of the kind for the key.
+func (d *DB) ClearAuthAttempts(kind string, key string) error {
+	_, err := d.Conn.Exec("DELETE FROM auth_attempts WHERE kind=$1 AND key=$2;", kind, key)
+	return err
+}
@@ -0,0 +1,109 @@
+package db
+
+// The personal_access_tokens table seed script:
+// CREATE TABLE personal_access_tokens (
+//     id SERIAL PRIMARY KEY,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     name VARCHAR(255) NOT NULL,
+//     token_hash VARCHAR(64) NOT NULL UNIQUE,
+//     scopes VARCHAR(255) NOT NULL,
+//     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+//     expires_at TIMESTAMPTZ,
+//     last_used_at TIMESTAMPTZ
+// );
+
+import (
+	"backend/models"
+	"database/sql"
+	"strings"
+)
+
+// AddAccessToken stores a new personal access token by the hash of the token and returns its ID.
+func (d *DB) AddAccessToken(token models.AccessToken, tokenHash string) (int, error) {
+	var id int
+	err := d.Conn.QueryRow(
+		`INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id;`,
+		token.UserID,
+		token.Name,
+		tokenHash,
+		strings.Join(token.Scopes, ","),
+		token.ExpiresAt,
+	).Scan(&id)
+	return id, err
+}
+
+// GetAccessTokens returns the personal access tokens of the user, oldest first.
+func (d *DB) GetAccessTokens(userID int) ([]models.AccessToken, error) {
+	rows, err := d.Conn.Query(
+		`SELECT id, name, scopes, created_at, expires_at, last_used_at
+		FROM personal_access_tokens WHERE user_id=$1 ORDER BY id;`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.AccessToken{}
+	for rows.Next() {
+		token := models.AccessToken{UserID: userID}
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+		err := rows.Scan(&token.ID, &token.Name, &scopes, &token.CreatedAt, &expiresAt, &lastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		token.Scopes = strings.Split(scopes, ",")
+		if expiresAt.Valid {
+			token.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			token.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// UseAccessToken looks up an unexpired personal access token by its hash, records that it was used
+// and returns it together with its user's username. It returns sql.ErrNoRows if there is no such
+// token.
+func (d *DB) UseAccessToken(tokenHash string) (*models.AccessToken, string, error) {
+	var token models.AccessToken
+	var scopes string
+	var username string
+	err := d.Conn.QueryRow(
+		`UPDATE personal_access_tokens SET last_used_at = now()
+		FROM users
+		WHERE personal_access_tokens.token_hash = $1
+		AND users.id = personal_access_tokens.user_id
+		AND (personal_access_tokens.expires_at IS NULL OR personal_access_tokens.expires_at > now())
+		RETURNING personal_access_tokens.id, personal_access_tokens.user_id,
+			personal_access_tokens.name, personal_access_tokens.scopes, users.username;`,
+		tokenHash,
+	).Scan(&token.ID, &token.UserID, &token.Name, &scopes, &username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token.Scopes = strings.Split(scopes, ",")
+	return &token, username, nil
+}
+
+// DeleteAccessToken revokes one of the user's personal access tokens. It returns false if the user
+// has no token with the ID.
+func (d *DB) DeleteAccessToken(userID int, id int) (bool, error) {
+	result, err := d.Conn.Exec(
+		"DELETE FROM personal_access_tokens WHERE id=$1 AND user_id=$2;",
+		id,
+		userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
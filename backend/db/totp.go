@@ -0,0 +1,134 @@
+package db
+
+// The two-factor authentication seed script:
+// ALTER TABLE users
+//     ADD COLUMN totp_secret VARCHAR(64),
+//     ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT false,
+//     ADD COLUMN totp_last_counter BIGINT;
+// CREATE TABLE recovery_codes (
+//     id SERIAL PRIMARY KEY,
+//     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+//     code_hash VARCHAR(64) NOT NULL,
+//     used_at TIMESTAMPTZ
+// );
+// CREATE INDEX recovery_codes_user_id ON recovery_codes (user_id);
+
+import "database/sql"
+
+// SetPendingTOTPSecret stores a new TOTP secret for the user without enabling it. It only takes
+// effect once EnableTOTP is called after the user confirms a code generated from it.
+func (d *DB) SetPendingTOTPSecret(userID int, secret string) error {
+	_, err := d.Conn.Exec(
+		"UPDATE users SET totp_secret=$2, totp_last_counter=NULL WHERE id=$1 AND NOT totp_enabled;",
+		userID,
+		secret,
+	)
+	return err
+}
+
+// GetTOTPSecret returns the user's TOTP secret, which is empty if the user has never enrolled.
+func (d *DB) GetTOTPSecret(userID int) (string, error) {
+	var secret sql.NullString
+	err := d.Conn.QueryRow("SELECT totp_secret FROM users WHERE id=$1;", userID).Scan(&secret)
+	if err != nil {
+		return "", err
+	}
+	return secret.String, nil
+}
+
+// EnableTOTP turns on two-factor authentication for the user and replaces their recovery codes
+// with the given hashes.
+func (d *DB) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET totp_enabled=true WHERE id=$1;", userID)
+	if err != nil {
+		return err
+	}
+	err = replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP turns off two-factor authentication for the user, removing their secret and
+// recovery codes.
+func (d *DB) DisableTOTP(userID int) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`UPDATE users SET totp_enabled=false, totp_secret=NULL, totp_last_counter=NULL
+		WHERE id=$1;`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	err = replaceRecoveryCodes(tx, userID, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPCounter records that the TOTP code for the given time step has been used. It returns
+// false if a code for this or a later time step was already used, so every code works only once.
+func (d *DB) UseTOTPCounter(userID int, counter int64) (bool, error) {
+	result, err := d.Conn.Exec(
+		`UPDATE users SET totp_last_counter=$2
+		WHERE id=$1 AND (totp_last_counter IS NULL OR totp_last_counter < $2);`,
+		userID,
+		counter,
+	)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// UseRecoveryCode marks one of the user's unused recovery codes as used. It returns false if no
+// unused recovery code has the given hash.
+func (d *DB) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	result, err := d.Conn.Exec(
+		`UPDATE recovery_codes SET used_at=now()
+		WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL;`,
+		userID,
+		codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and stores the given hashes instead.
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codeHashes []string) error {
+	_, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id=$1;", userID)
+	if err != nil {
+		return err
+	}
+	for _, codeHash := range codeHashes {
+		_, err = tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2);",
+			userID,
+			codeHash,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package db
+
+// The email verification seed script:
+// ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT false;
+// ALTER TABLE users ADD COLUMN email_verification_sent_at TIMESTAMPTZ;
+
+import "time"
+
+// ReserveVerificationEmail records that a verification email is being sent to the user's current,
+// unverified email address. It returns false without recording anything if the user has no such
+// address or if the last verification email was sent less than the interval ago.
+func (d *DB) ReserveVerificationEmail(userID int, interval time.Duration) (bool, error) {
+	result, err := d.Conn.Exec(
+		`UPDATE users SET email_verification_sent_at=now()
+		WHERE id=$1 AND email IS NOT NULL AND NOT email_verified
+		AND (email_verification_sent_at IS NULL OR email_verification_sent_at < $2);`,
+		userID,
+		time.Now().Add(-interval),
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// MarkEmailVerified marks the user's email address as verified. It returns false if the user's
+// address is no longer the one the verification link was sent to, or if another user has verified
+// the address in the meantime.
+func (d *DB) MarkEmailVerified(userID int, email string) (bool, error) {
+	result, err := d.Conn.Exec(
+		`UPDATE users SET email_verified=true WHERE id=$1 AND lower(email)=lower($2)
+		AND NOT exists (SELECT 1 FROM users WHERE lower(email)=lower($2) AND email_verified);`,
+		userID,
+		email,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
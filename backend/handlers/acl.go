@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"backend/auth"
+	"backend/db"
+	"backend/models"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// deviceAccess maps the devices a restricted member of an organization has been granted to whether
+// they may edit them. A nil deviceAccess gives access to every device.
+type deviceAccess map[string]bool
+
+// canView reports whether the device may be seen, and its personal settings changed.
+func (a deviceAccess) canView(deviceID string) bool {
+	if a == nil {
+		return true
+	}
+	_, ok := a[deviceID]
+	return ok
+}
+
+// canEdit reports whether the device's settings may be changed for the whole organization.
+func (a deviceAccess) canEdit(deviceID string) bool {
+	return a == nil || a[deviceID]
+}
+
+// loadDeviceAccess returns the devices the user making the request has access to. Outside an
+// organization, users have access to their whole fleet, and so do admins and owners of an
+// organization. Other members only have access to their grants if they are restricted.
+func loadDeviceAccess(db *db.DB, r *http.Request) (deviceAccess, error) {
+	orgID, role := auth.OrganizationFromContext(r.Context())
+	return loadMemberDeviceAccess(db, orgID, auth.UserIDFromContext(r.Context()), role)
+}
+
+// loadMemberDeviceAccess returns the devices a user with the given role in the organization has
+// access to, like loadDeviceAccess.
+func loadMemberDeviceAccess(db *db.DB, orgID int, userID int, role auth.Role) (deviceAccess, error) {
+	if orgID == 0 || role.AtLeast(auth.RoleAdmin) {
+		return nil, nil
+	}
+	return db.GetDeviceAccess(orgID, userID)
+}
+
+// HandleGetGroups lists the groups of the organization the request acts in.
+func (o *OrganizationService) HandleGetGroups(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	groups, err := o.DB.GetGroups(orgID)
+	if err != nil {
+		http.Error(w, "Error fetching groups: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(groups)
+}
+
+// HandleCreateGroup creates a group in the organization the request acts in.
+func (o *OrganizationService) HandleCreateGroup(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		Name string `json:"name"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	if reqBody.Name == "" || len(reqBody.Name) > 255 {
+		http.Error(w, "Name must be between 1 and 255 characters long", http.StatusBadRequest)
+		return
+	}
+
+	groupID, err := o.DB.CreateGroup(orgID, reqBody.Name)
+	if err != nil {
+		http.Error(w, "Error creating group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(models.Group{ID: groupID, Name: reqBody.Name, Members: []string{}})
+}
+
+// HandleDeleteGroup deletes a group of the organization the request acts in, along with the devices
+// granted to it.
+func (o *OrganizationService) HandleDeleteGroup(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		ID int `json:"id"`
+	}
+	if !decodeRequest(w, r, &reqBody) || !pathID(w, r, "id", &reqBody.ID) {
+		return
+	}
+
+	deleted, err := o.DB.DeleteGroup(orgID, reqBody.ID)
+	if err != nil {
+		http.Error(w, "Error deleting group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleAddGroupMember adds a member of the organization the request acts in to one of its groups.
+func (o *OrganizationService) HandleAddGroupMember(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		GroupID  int    `json:"group_id"`
+		Username string `json:"username"`
+	}
+	if !decodeRequest(w, r, &reqBody) || !pathID(w, r, "id", &reqBody.GroupID) {
+		return
+	}
+	pathValue(r, "username", &reqBody.Username)
+
+	memberID, ok := o.requireMember(w, orgID, reqBody.Username)
+	if !ok {
+		return
+	}
+
+	added, err := o.DB.AddGroupMember(orgID, reqBody.GroupID, memberID)
+	if err != nil {
+		http.Error(w, "Error adding group member: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !added {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleRemoveGroupMember removes a member of the organization the request acts in from one of its
+// groups.
+func (o *OrganizationService) HandleRemoveGroupMember(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		GroupID  int    `json:"group_id"`
+		Username string `json:"username"`
+	}
+	if !decodeRequest(w, r, &reqBody) || !pathID(w, r, "id", &reqBody.GroupID) {
+		return
+	}
+	pathValue(r, "username", &reqBody.Username)
+
+	memberID, ok := o.requireMember(w, orgID, reqBody.Username)
+	if !ok {
+		return
+	}
+
+	removed, err := o.DB.RemoveGroupMember(orgID, reqBody.GroupID, memberID)
+	if err != nil {
+		http.Error(w, "Error removing group member: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Group member not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleGetDeviceGrants lists the device grants of the organization the request acts in.
+func (o *OrganizationService) HandleGetDeviceGrants(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	grants, err := o.DB.GetDeviceGrants(orgID)
+	if err != nil {
+		http.Error(w, "Error fetching device grants: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(grants)
+}
+
+// HandleCreateDeviceGrant grants a member or a group of the organization the request acts in view or
+// edit access to a device. Grants only take effect for restricted members.
+func (o *OrganizationService) HandleCreateDeviceGrant(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		DeviceID string `json:"device_id"`
+		Username string `json:"username"`
+		GroupID  int    `json:"group_id"`
+		Access   string `json:"access"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	if reqBody.DeviceID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Access != "view" && reqBody.Access != "edit" {
+		http.Error(w, "Access must be view or edit", http.StatusBadRequest)
+		return
+	}
+	if (reqBody.Username == "") == (reqBody.GroupID == 0) {
+		http.Error(w, "Exactly one of username and group_id must be set", http.StatusBadRequest)
+		return
+	}
+
+	grant := models.DeviceGrant{DeviceID: reqBody.DeviceID, Access: reqBody.Access}
+	if reqBody.Username != "" {
+		memberID, ok := o.requireMember(w, orgID, reqBody.Username)
+		if !ok {
+			return
+		}
+		grant.UserID = &memberID
+		grant.Username = reqBody.Username
+	} else {
+		exists, err := o.DB.GroupExists(orgID, reqBody.GroupID)
+		if err != nil {
+			http.Error(w, "Error fetching group: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+		grant.GroupID = &reqBody.GroupID
+	}
+
+	grantID, err := o.DB.AddDeviceGrant(orgID, grant)
+	if err != nil {
+		http.Error(w, "Error creating device grant: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	grant.ID = grantID
+
+	json.NewEncoder(w).Encode(grant)
+}
+
+// HandleDeleteDeviceGrant revokes a device grant of the organization the request acts in.
+func (o *OrganizationService) HandleDeleteDeviceGrant(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		ID int `json:"id"`
+	}
+	if !decodeRequest(w, r, &reqBody) || !pathID(w, r, "id", &reqBody.ID) {
+		return
+	}
+
+	deleted, err := o.DB.DeleteDeviceGrant(orgID, reqBody.ID)
+	if err != nil {
+		http.Error(w, "Error deleting device grant: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Device grant not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// requireMember looks up a member of the organization by their username, and responds with an error
+// if there is none. It returns the member's user ID.
+func (o *OrganizationService) requireMember(w http.ResponseWriter, orgID int, username string) (int, bool) {
+	member, err := o.DB.GetUserByUsername(username)
+	if err == nil {
+		_, err = o.DB.GetMemberRole(orgID, member.ID)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return 0, false
+		}
+		http.Error(w, "Error fetching member: "+err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return member.ID, true
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"backend/auth"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// HandleSetUserCredentials registers the OneStepGPS API key of the user's own fleet, which they see
+// outside of organizations. An empty key removes it.
+func (d *DeviceService) HandleSetUserCredentials(w http.ResponseWriter, r *http.Request, username string) {
+	userID := auth.UserIDFromContext(r.Context())
+	d.setCredentials(w, r, userCredentialsContext(userID), func(sealed string) error {
+		return d.DB.SetUserAPIKey(userID, sealed)
+	})
+}
+
+// HandleSetOrganizationCredentials registers the OneStepGPS API key of the fleet of the
+// organization the request acts in. An empty key removes it. Only owners can change it.
+func (d *DeviceService) HandleSetOrganizationCredentials(
+	w http.ResponseWriter,
+	r *http.Request,
+	username string,
+) {
+	orgID, ok := requireRole(w, r, auth.RoleOwner)
+	if !ok {
+		return
+	}
+	d.setCredentials(w, r, organizationCredentialsContext(orgID), func(sealed string) error {
+		return d.DB.SetOrganizationAPIKey(orgID, sealed)
+	})
+}
+
+// setCredentials validates the API key in the request body against the OneStepGPS API, seals it
+// for the given context and stores it with the store function.
+func (d *DeviceService) setCredentials(
+	w http.ResponseWriter,
+	r *http.Request,
+	context string,
+	store func(sealed string) error,
+) {
+	if d.Secrets == nil {
+		http.Error(w, "Credential encryption is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		APIKey string `json:"api_key"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+
+	// Check that the key works before storing it
+	var sealed string
+	if reqBody.APIKey != "" {
+		_, err := d.fetchDevices(reqBody.APIKey)
+		if err != nil {
+			http.Error(w, "API key rejected: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sealed, err = d.Secrets.Seal(reqBody.APIKey, context)
+		if err != nil {
+			http.Error(w, "Error encrypting API key: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := store(sealed)
+	if err != nil {
+		http.Error(w, "Error updating credentials: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// ResealCredentials seals the stored OneStepGPS API keys of users and organizations with the
+// current key-encryption key, including plaintext keys stored before they were encrypted. It runs
+// on startup, so once it has run under a new current key the old keys can be removed from
+// SECRETS_KEYS. It returns how many keys were sealed again, and an error for each key that could
+// not be opened, such as one sealed with a key that was already removed.
+func (d *DeviceService) ResealCredentials() (int, []error, error) {
+	apiKeys, err := d.DB.GetUserAPIKeys()
+	if err != nil {
+		return 0, nil, err
+	}
+	resealed, failed, err := d.resealAPIKeys(apiKeys, userCredentialsContext, d.DB.ReplaceUserAPIKey)
+	if err != nil {
+		return resealed, failed, err
+	}
+
+	apiKeys, err = d.DB.GetOrganizationAPIKeys()
+	if err != nil {
+		return resealed, failed, err
+	}
+	orgResealed, orgFailed, err := d.resealAPIKeys(
+		apiKeys,
+		organizationCredentialsContext,
+		d.DB.ReplaceOrganizationAPIKey,
+	)
+	return resealed + orgResealed, append(failed, orgFailed...), err
+}
+
+// resealAPIKeys seals the API keys, by the ID of the row they are stored in, with the current
+// key-encryption key and stores them with the replace function.
+func (d *DeviceService) resealAPIKeys(
+	apiKeys map[int]string,
+	context func(int) string,
+	replace func(int, string, string) (bool, error),
+) (int, []error, error) {
+	resealed := 0
+	var failed []error
+	for id, apiKey := range apiKeys {
+		sealed, changed, err := d.Secrets.Reseal(apiKey, context(id))
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", context(id), err))
+			continue
+		}
+		if !changed {
+			continue
+		}
+		replaced, err := replace(id, apiKey, sealed)
+		if err != nil {
+			return resealed, failed, err
+		}
+		if replaced {
+			resealed++
+		}
+	}
+	return resealed, failed, nil
+}
+
+// userCredentialsContext and organizationCredentialsContext bind sealed API keys to their owner, so
+// a key copied to another row can't be decrypted.
+func userCredentialsContext(userID int) string {
+	return "onestepgps-api-key:user:" + strconv.Itoa(userID)
+}
+
+func organizationCredentialsContext(orgID int) string {
+	return "onestepgps-api-key:organization:" + strconv.Itoa(orgID)
+}
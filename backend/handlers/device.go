@@ -1,41 +1,60 @@
 package handlers
 
 import (
+	"backend/auth"
 	"backend/db"
 	"backend/models"
+	"backend/secrets"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"time"
 )
 
 type DeviceService struct {
-	APIKey string
-	DB     *db.DB
+	APIKey    string
+	DB        *db.DB
+	Secrets   *secrets.Box
+	tiles     *tileCache
+	snapshots *fleetSnapshotCache
+	shared    *sharedDevicesCache
 }
 
 func NewDeviceService(APIKey string, db *db.DB) (*DeviceService, error) {
 	if db == nil {
 		return nil, errors.New("db cannot be nil")
 	}
-	return &DeviceService{APIKey: APIKey, DB: db}, nil
+	return &DeviceService{
+		APIKey:    APIKey,
+		DB:        db,
+		tiles:     newTileCache(),
+		snapshots: newFleetSnapshotCache(),
+		shared:    newSharedDevicesCache(),
+	}, nil
 }
 
 // getDisplayNames retrieves the display names of devices from a remote API and returns them as a
-// JSON response.
-func (d *DeviceService) HandleGetDisplayNames(w http.ResponseWriter, r *http.Request) {
-	var apiResponse models.APIResponse
-	err := d.fetchAndUnmarshal(
-		"https://track.onestepgps.com/v3/api/public/device?latest_point=true&api-key="+
-			d.APIKey, &apiResponse)
+// JSON response. Anonymous requests get the devices of the global fleet that the route's policy
+// allows, redacted by it, and authenticated ones the devices of their fleet they have access to.
+func (d *DeviceService) HandleGetDisplayNames(w http.ResponseWriter, r *http.Request, username string) {
+	devices, err := d.fetchVisibleDevices(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Display names are all that this route serves, so hiding them leaves nothing to list
 	var displayNames []string
-	for _, device := range apiResponse.ResultList {
-		displayNames = append(displayNames, device.DisplayName)
+	redaction := auth.RedactionFromContext(r.Context())
+	if redaction == nil || !redaction.Fields["display_name"] {
+		for _, device := range devices {
+			displayNames = append(displayNames, device.DisplayName)
+		}
 	}
 
 	displayNamesJson, _ := json.Marshal(displayNames)
@@ -45,27 +64,52 @@ func (d *DeviceService) HandleGetDisplayNames(w http.ResponseWriter, r *http.Req
 
 // getDeviceLocations retrieves the latest device locations from the OneStepGPS API
 // and writes the locations as JSON to the HTTP response.
-func (d *DeviceService) HandleGetDeviceLocations(w http.ResponseWriter, r *http.Request) {
-	var apiResponse models.APIResponse
-	err := d.fetchAndUnmarshal(
-		"https://track.onestepgps.com/v3/api/public/device?latest_point=true&api-key="+
-			d.APIKey, &apiResponse)
+// If the predict_at query parameter is set, moving devices are extrapolated to that time.
+// Anonymous requests get the devices of the global fleet that the route's policy allows, redacted
+// by it, and authenticated ones the devices of their fleet they have access to. Requests whose coordinates are rounded cannot
+// use predict_at, since comparing predictions would reveal movement within the rounded area.
+func (d *DeviceService) HandleGetDeviceLocations(w http.ResponseWriter, r *http.Request, username string) {
+	predictAt, err := parsePredictAt(r)
+	if err != nil {
+		http.Error(w, "Invalid predict_at", http.StatusBadRequest)
+		return
+	}
+	redaction := auth.RedactionFromContext(r.Context())
+	if !predictAt.IsZero() && redaction != nil && redaction.CoordinatePrecision >= 0 {
+		http.Error(w, "predict_at is not available with rounded coordinates", http.StatusBadRequest)
+		return
+	}
+
+	devices, err := d.fetchVisibleDevices(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	now := time.Now()
 	var locations []models.Device
-	for _, device := range apiResponse.ResultList {
-		locations = append(locations, models.Device{
+	for _, device := range devices {
+		location := models.Device{
 			DeviceID:    device.DeviceID,
 			DisplayName: device.DisplayName,
 			Latitude:    device.LatestDevicePoint.Latitude,
 			Longitude:   device.LatestDevicePoint.Longitude,
 			Altitude:    device.LatestDevicePoint.Altitude,
 			Angle:       device.LatestDevicePoint.Angle,
-			IsHidden:    false,
-		})
+			Speed:       device.LatestDevicePoint.Speed,
+			Velocity: estimateVelocity(
+				device.LatestDevicePoint.Speed,
+				device.LatestDevicePoint.Angle,
+				device.LatestDevicePoint.DtTracker,
+				now,
+			),
+			IsHidden: false,
+		}
+		if !predictAt.IsZero() {
+			predictPosition(&location, predictAt)
+		}
+		redactDevice(&location, redaction)
+		locations = append(locations, location)
 	}
 
 	locationsJson, _ := json.Marshal(locations)
@@ -75,26 +119,26 @@ func (d *DeviceService) HandleGetDeviceLocations(w http.ResponseWriter, r *http.
 
 func (d *DeviceService) HandleHideDevice(w http.ResponseWriter, r *http.Request, username string) {
 	// Parse and validate the request body
-	var reqBody map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&reqBody)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var reqBody struct {
+		DeviceID *string `json:"device_id"`
+		Hide     *bool   `json:"hide"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
 		return
 	}
-
-	deviceID, ok := reqBody["device_id"].(string)
-	if !ok {
+	if reqBody.DeviceID == nil {
 		http.Error(w, "Invalid device_id", http.StatusBadRequest)
 		return
 	}
-
-	hide, ok := reqBody["hide"].(bool)
-	if !ok {
+	if !d.requireDeviceAccess(w, r, *reqBody.DeviceID) {
+		return
+	}
+	if reqBody.Hide == nil {
 		http.Error(w, "Invalid hide", http.StatusBadRequest)
 		return
 	}
 
-	err = d.DB.HideDevice(username, deviceID, hide)
+	err := d.DB.HideDevice(auth.UserIDFromContext(r.Context()), *reqBody.DeviceID, *reqBody.Hide)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -104,11 +148,19 @@ func (d *DeviceService) HandleHideDevice(w http.ResponseWriter, r *http.Request,
 }
 
 func (d *DeviceService) HandleGetHiddenDevices(w http.ResponseWriter, r *http.Request, username string) {
-	hiddenDevices, err := d.DB.GetHiddenDevices(username)
+	hiddenDevices, err := d.DB.GetHiddenDevices(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	access, err := loadDeviceAccess(d.DB, r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	hiddenDevices = slices.DeleteFunc(hiddenDevices, func(deviceID string) bool {
+		return !access.canView(deviceID)
+	})
 
 	hiddenDevicesJson, _ := json.Marshal(hiddenDevices)
 	w.Header().Set("Content-Type", "application/json")
@@ -117,26 +169,26 @@ func (d *DeviceService) HandleGetHiddenDevices(w http.ResponseWriter, r *http.Re
 
 func (d *DeviceService) HandleChangeColor(w http.ResponseWriter, r *http.Request, username string) {
 	// Parse and validate the request body
-	var reqBody map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&reqBody)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var reqBody struct {
+		DeviceID *string `json:"device_id"`
+		Color    *string `json:"color"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
 		return
 	}
-
-	deviceID, ok := reqBody["device_id"].(string)
-	if !ok {
+	if reqBody.DeviceID == nil {
 		http.Error(w, "Invalid device_id", http.StatusBadRequest)
 		return
 	}
-
-	color, ok := reqBody["color"].(string)
-	if !ok {
+	if !d.requireDeviceAccess(w, r, *reqBody.DeviceID) {
+		return
+	}
+	if reqBody.Color == nil {
 		http.Error(w, "Invalid color", http.StatusBadRequest)
 		return
 	}
 
-	err = d.DB.ChangeColor(username, deviceID, color)
+	err := d.DB.ChangeColor(auth.UserIDFromContext(r.Context()), *reqBody.DeviceID, *reqBody.Color)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -145,33 +197,264 @@ func (d *DeviceService) HandleChangeColor(w http.ResponseWriter, r *http.Request
 	w.WriteHeader(http.StatusOK)
 }
 
+// HandleGetDeviceSettings returns the latest device locations merged with the user's settings. If
+// the predict_at query parameter is set, moving devices are extrapolated to that time.
 func (d *DeviceService) HandleGetDeviceSettings(w http.ResponseWriter, r *http.Request, username string) {
-	var apiResponse models.APIResponse
-	err := d.fetchAndUnmarshal(
-		"https://track.onestepgps.com/v3/api/public/device?latest_point=true&api-key="+
-			d.APIKey, &apiResponse)
+	predictAt, err := parsePredictAt(r)
+	if err != nil {
+		http.Error(w, "Invalid predict_at", http.StatusBadRequest)
+		return
+	}
+
+	locations, err := d.getDevicesWithSettings(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !predictAt.IsZero() {
+		for i := range locations {
+			predictPosition(&locations[i], predictAt)
+		}
+	}
 
-	// Get the device settings from the database
-	deviceSettingsMap, err := d.DB.GetDeviceSettings(username)
+	locationsJson, _ := json.Marshal(locations)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(locationsJson)
+}
+
+func (d *DeviceService) HandleChangeNickname(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		DeviceID *string `json:"device_id"`
+		Nickname *string `json:"nickname"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	if reqBody.DeviceID == nil {
+		http.Error(w, "Invalid device_id", http.StatusBadRequest)
+		return
+	}
+	if !d.requireDeviceAccess(w, r, *reqBody.DeviceID) {
+		return
+	}
+	if reqBody.Nickname == nil {
+		http.Error(w, "Invalid nickname", http.StatusBadRequest)
+		return
+	}
+
+	err := d.DB.ChangeNickname(auth.UserIDFromContext(r.Context()), *reqBody.DeviceID, *reqBody.Nickname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// maxSettingsPatches is how many devices a batch of settings patches can change at most.
+const maxSettingsPatches = 500
+
+// patchError is a validation error of one patch of a batch.
+type patchError struct {
+	Index    int    `json:"index"`
+	DeviceID string `json:"device_id"`
+	Error    string `json:"error"`
+}
+
+// HandlePatchDeviceSettings applies a batch of patches to the user's device settings, each setting
+// any of is_hidden, color and nickname of one device. Either every patch is applied, in one
+// transaction, or none are, and the response lists the validation error of each invalid patch.
+// Unknown fields are rejected, so a misspelled setting isn't silently ignored.
+func (d *DeviceService) HandlePatchDeviceSettings(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Patches []models.DeviceSettingsPatch `json:"patches"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(reqBody.Patches) == 0 || len(reqBody.Patches) > maxSettingsPatches {
+		http.Error(w, "A batch must have between 1 and 500 patches", http.StatusBadRequest)
+		return
+	}
+
+	access, err := loadDeviceAccess(d.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !respondWithPatchErrors(w, reqBody.Patches, access) {
+		return
+	}
+
+	err = d.DB.PatchDeviceSettings(auth.UserIDFromContext(r.Context()), reqBody.Patches)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"updated": len(reqBody.Patches)})
+}
+
+// HandleGetDeviceSettingsByID returns the user's settings for the device in the
+// /api/v1/devices/{id}/settings path, which fall back to the organization's defaults.
+func (d *DeviceService) HandleGetDeviceSettingsByID(w http.ResponseWriter, r *http.Request, username string) {
+	deviceID := r.PathValue("id")
+	if !d.requireDeviceAccess(w, r, deviceID) {
+		return
+	}
+	d.respondWithDeviceSettings(w, r, deviceID)
+}
+
+// HandlePatchDeviceSettingsByID changes any of is_hidden, color and nickname of the user's settings
+// for the device in the /api/v1/devices/{id}/settings path, and returns the resulting settings.
+func (d *DeviceService) HandlePatchDeviceSettingsByID(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		IsHidden *bool   `json:"is_hidden"`
+		Nickname *string `json:"nickname"`
+		Color    *string `json:"color"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	patch := models.DeviceSettingsPatch{
+		DeviceID: r.PathValue("id"),
+		IsHidden: reqBody.IsHidden,
+		Nickname: reqBody.Nickname,
+		Color:    reqBody.Color,
+	}
+	if !d.requireDeviceAccess(w, r, patch.DeviceID) {
+		return
+	}
+	// Access was checked above, a nil deviceAccess lets the patch through
+	if message := validatePatch(patch, nil, nil); message != "" {
+		http.Error(w, message, http.StatusBadRequest)
+		return
+	}
+
+	err = d.DB.PatchDeviceSettings(auth.UserIDFromContext(r.Context()), []models.DeviceSettingsPatch{patch})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d.respondWithDeviceSettings(w, r, patch.DeviceID)
+}
+
+// respondWithDeviceSettings responds with the user's settings for the device.
+func (d *DeviceService) respondWithDeviceSettings(w http.ResponseWriter, r *http.Request, deviceID string) {
+	userID := auth.UserIDFromContext(r.Context())
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	deviceSettingsMap, err := d.DB.GetDeviceSettings(userID, orgID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deviceSettings, ok := deviceSettingsMap[deviceID]
+	if !ok {
+		deviceSettings = defaultDeviceSettings(deviceID)
+	}
+	deviceSettings.DeviceID = deviceID
+	deviceSettings.UserID = userID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deviceSettings)
+}
+
+// defaultDeviceSettings returns the global default settings of a device, which apply when neither
+// the user nor their organization has set any.
+func defaultDeviceSettings(deviceID string) models.DeviceSettings {
+	return models.DeviceSettings{
+		DeviceID: deviceID,
+		IsHidden: false,
+		Color:    "#AA4A44",
+		Nickname: "",
+	}
+}
+
+// validatePatch checks one patch of a batch, given the devices earlier patches of the batch
+// changed, and returns why it is invalid, or an empty string if it is valid.
+func validatePatch(patch models.DeviceSettingsPatch, access deviceAccess, seen map[string]bool) string {
+	switch {
+	case patch.DeviceID == "":
+		return "Missing device_id"
+	case seen[patch.DeviceID]:
+		return "Device is patched more than once"
+	case patch.IsHidden == nil && patch.Color == nil && patch.Nickname == nil:
+		return "At least one of is_hidden, color and nickname must be set"
+	case patch.Color != nil && (*patch.Color == "" || len(*patch.Color) > 255):
+		return "Color must be between 1 and 255 characters long"
+	case patch.Nickname != nil && len(*patch.Nickname) > 255:
+		return "Nickname must be at most 255 characters long"
+	case !access.canView(patch.DeviceID):
+		return "No access to the device"
+	}
+	return ""
+}
+
+// respondWithPatchErrors validates a batch of patches with validatePatch and responds with the
+// error of each invalid patch. It returns true if all patches are valid.
+func respondWithPatchErrors(
+	w http.ResponseWriter,
+	patches []models.DeviceSettingsPatch,
+	access deviceAccess,
+) bool {
+	patchErrors := []patchError{}
+	seen := make(map[string]bool)
+	for i, patch := range patches {
+		message := validatePatch(patch, access, seen)
+		if message != "" {
+			patchErrors = append(patchErrors, patchError{
+				Index:    i,
+				DeviceID: patch.DeviceID,
+				Error:    message,
+			})
+		}
+		seen[patch.DeviceID] = true
+	}
+	if len(patchErrors) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string][]patchError{"errors": patchErrors})
+		return false
+	}
+	return true
+}
+
+// getDevicesWithSettings fetches the latest locations of the devices the user making the request
+// has access to from the OneStepGPS API and merges them with the user's device settings, which fall
+// back to the organization's defaults. Devices without any stored settings get the global defaults.
+func (d *DeviceService) getDevicesWithSettings(r *http.Request) ([]models.Device, error) {
+	devices, err := d.fetchVisibleDevices(r)
+	if err != nil {
+		return nil, err
+	}
+	userID := auth.UserIDFromContext(r.Context())
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+
+	// Get the device settings from the database
+	deviceSettingsMap, err := d.DB.GetDeviceSettings(userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
 	var locations []models.Device
-	for _, device := range apiResponse.ResultList {
+	for _, device := range devices {
 		deviceSettings, ok := deviceSettingsMap[device.DeviceID]
 		if !ok {
-			// Initialize default settings for the device
-			deviceSettings = models.DeviceSettings{
-				IsHidden: false,
-				Color:    "#AA4A44",
-				Nickname: "",
-			}
+			deviceSettings = defaultDeviceSettings(device.DeviceID)
 		}
 		locations = append(locations, models.Device{
 			DeviceID:    device.DeviceID,
@@ -180,60 +463,162 @@ func (d *DeviceService) HandleGetDeviceSettings(w http.ResponseWriter, r *http.R
 			Longitude:   device.LatestDevicePoint.Longitude,
 			Altitude:    device.LatestDevicePoint.Altitude,
 			Angle:       device.LatestDevicePoint.Angle,
-			IsHidden:    deviceSettings.IsHidden,
-			Color:       deviceSettings.Color,
-			Nickname:    deviceSettings.Nickname,
+			Speed:       device.LatestDevicePoint.Speed,
+			Velocity: estimateVelocity(
+				device.LatestDevicePoint.Speed,
+				device.LatestDevicePoint.Angle,
+				device.LatestDevicePoint.DtTracker,
+				now,
+			),
+			IsHidden: deviceSettings.IsHidden,
+			Color:    deviceSettings.Color,
+			Nickname: deviceSettings.Nickname,
 		})
 	}
+	return locations, nil
+}
 
-	locationsJson, _ := json.Marshal(locations)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(locationsJson)
+// fetchVisibleDevices fetches the devices the request may see. Anonymous requests see the devices
+// of the global fleet behind APIKey that their redaction allows. Authenticated requests see the devices of their fleet that the user has
+// access to, see loadDeviceAccess, narrowed down to a device group or tag if the request selects
+// one (see selectDevices).
+func (d *DeviceService) fetchVisibleDevices(r *http.Request) ([]models.DeviceResponse, error) {
+	userID := auth.UserIDFromContext(r.Context())
+	if userID == 0 {
+		apiResponse, err := d.fetchDevices(d.APIKey)
+		if err != nil {
+			return nil, err
+		}
+		redaction := auth.RedactionFromContext(r.Context())
+		if redaction == nil || redaction.DeviceIDs == nil {
+			return apiResponse.ResultList, nil
+		}
+		return slices.DeleteFunc(apiResponse.ResultList, func(device models.DeviceResponse) bool {
+			return !redaction.DeviceIDs[device.DeviceID]
+		}), nil
+	}
+
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	apiResponse, err := d.fetchFleet(userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	access, err := loadDeviceAccess(d.DB, r)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := d.selectDevices(r)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(apiResponse.ResultList, func(device models.DeviceResponse) bool {
+		return !access.canView(device.DeviceID) ||
+			(selected != nil && !slices.Contains(selected, device.DeviceID))
+	}), nil
 }
 
-func (d *DeviceService) HandleChangeNickname(w http.ResponseWriter, r *http.Request, username string) {
-	// Parse and validate the request body
-	var reqBody map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&reqBody)
+// requireDeviceAccess checks that the user making the request has access to the device, and
+// responds with an error if not.
+func (d *DeviceService) requireDeviceAccess(w http.ResponseWriter, r *http.Request, deviceID string) bool {
+	access, err := loadDeviceAccess(d.DB, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !access.canView(deviceID) {
+		http.Error(w, "No access to the device", http.StatusForbidden)
+		return false
 	}
+	return true
+}
 
-	deviceID, ok := reqBody["device_id"].(string)
-	if !ok {
-		http.Error(w, "Invalid device_id", http.StatusBadRequest)
-		return
+// usesGlobalFleet reports whether fetchFleet falls back to the global fleet for the user outside
+// an organization, because they have no OneStepGPS API key of their own.
+func (d *DeviceService) usesGlobalFleet(userID int, orgID int) (bool, error) {
+	if orgID != 0 {
+		return false, nil
 	}
+	sealed, err := d.DB.GetUserAPIKey(userID)
+	return sealed == "", err
+}
 
-	nickname, ok := reqBody["nickname"].(string)
-	if !ok {
-		http.Error(w, "Invalid nickname", http.StatusBadRequest)
-		return
+// fetchFleet fetches the devices of the fleet a request acts on. That is the organization's fleet,
+// or outside an organization, when orgID is 0, the user's own fleet. Users without their own
+// OneStepGPS API key see the global fleet behind APIKey.
+func (d *DeviceService) fetchFleet(userID int, orgID int) (*models.APIResponse, error) {
+	var sealed, context string
+	var err error
+	if orgID != 0 {
+		sealed, err = d.DB.GetOrganizationAPIKey(orgID)
+		context = organizationCredentialsContext(orgID)
+	} else {
+		sealed, err = d.DB.GetUserAPIKey(userID)
+		context = userCredentialsContext(userID)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	err = d.DB.ChangeNickname(username, deviceID, nickname)
+	if sealed == "" {
+		if orgID != 0 || d.APIKey == "" {
+			return nil, errors.New("no OneStepGPS credentials have been registered")
+		}
+		return d.fetchDevices(d.APIKey)
+	}
+	if d.Secrets == nil {
+		return nil, errors.New("credential encryption is not configured")
+	}
+	apiKey, err := d.Secrets.Open(sealed, context)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("decrypting OneStepGPS credentials: %w", err)
 	}
+	return d.fetchDevices(apiKey)
+}
 
-	w.WriteHeader(http.StatusOK)
+// fetchDevices fetches the devices and their latest points from the OneStepGPS API.
+func (d *DeviceService) fetchDevices(apiKey string) (*models.APIResponse, error) {
+	var apiResponse models.APIResponse
+	err := d.fetchAndUnmarshal(
+		"https://track.onestepgps.com/v3/api/public/device?latest_point=true&api-key="+
+			url.QueryEscape(apiKey), &apiResponse)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResponse, nil
 }
 
+// errOneStepGPS is returned instead of the errors of requests to the OneStepGPS API. Their URL
+// contains the API key, and the errors of http.Get include it.
+var errOneStepGPS = errors.New("Error fetching devices from OneStepGPS")
+
 // fetchAndUnmarshal fetches data from the specified URL and unmarshals it into the provided value.
-// It returns an error if there was a problem fetching the data or unmarshaling it.
-func (d *DeviceService) fetchAndUnmarshal(url string, v interface{}) error {
-	resp, err := http.Get(url)
+// It returns an error if there was a problem fetching the data or unmarshaling it. The details are
+// only logged, without the URL, since the returned errors are shown to clients.
+func (d *DeviceService) fetchAndUnmarshal(requestURL string, v interface{}) error {
+	resp, err := http.Get(requestURL)
 	if err != nil {
-		return err
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		log.Printf("Error fetching from OneStepGPS: %v", err)
+		return errOneStepGPS
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OneStepGPS API responded with %s", resp.Status)
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		log.Printf("Error reading OneStepGPS response: %v", err)
+		return errOneStepGPS
 	}
 
-	return json.Unmarshal(body, v)
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		log.Printf("Error decoding OneStepGPS response: %v", err)
+		return errOneStepGPS
+	}
+	return nil
 }
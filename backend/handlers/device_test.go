@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"backend/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchAndUnmarshalHidesAPIKey(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"unreachable host", closed.URL + "/device?api-key=SECRETKEY"},
+		{"invalid response", failing.URL + "/device?api-key=SECRETKEY"},
+	}
+	d := &DeviceService{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var v struct{}
+			err := d.fetchAndUnmarshal(test.url, &v)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if strings.Contains(err.Error(), "SECRETKEY") {
+				t.Errorf("error contains the API key: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidatePatch(t *testing.T) {
+	hidden := true
+	color := "#112233"
+	empty := ""
+	long := strings.Repeat("a", 256)
+	restricted := deviceAccess{"a": false, "b": true}
+
+	tests := []struct {
+		name   string
+		patch  models.DeviceSettingsPatch
+		access deviceAccess
+		want   string
+	}{
+		{"valid", models.DeviceSettingsPatch{DeviceID: "a", IsHidden: &hidden}, nil, ""},
+		{"granted device", models.DeviceSettingsPatch{DeviceID: "a", Color: &color}, restricted, ""},
+		{"missing device", models.DeviceSettingsPatch{IsHidden: &hidden}, nil, "Missing device_id"},
+		{
+			"patched twice",
+			models.DeviceSettingsPatch{DeviceID: "seen", IsHidden: &hidden},
+			nil,
+			"Device is patched more than once",
+		},
+		{
+			"nothing to change",
+			models.DeviceSettingsPatch{DeviceID: "a"},
+			nil,
+			"At least one of is_hidden, color and nickname must be set",
+		},
+		{
+			"empty color",
+			models.DeviceSettingsPatch{DeviceID: "a", Color: &empty},
+			nil,
+			"Color must be between 1 and 255 characters long",
+		},
+		{
+			"long color",
+			models.DeviceSettingsPatch{DeviceID: "a", Color: &long},
+			nil,
+			"Color must be between 1 and 255 characters long",
+		},
+		{"empty nickname", models.DeviceSettingsPatch{DeviceID: "a", Nickname: &empty}, nil, ""},
+		{
+			"long nickname",
+			models.DeviceSettingsPatch{DeviceID: "a", Nickname: &long},
+			nil,
+			"Nickname must be at most 255 characters long",
+		},
+		{
+			"device without access",
+			models.DeviceSettingsPatch{DeviceID: "c", IsHidden: &hidden},
+			restricted,
+			"No access to the device",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := validatePatch(test.patch, test.access, map[string]bool{"seen": true})
+			if got != test.want {
+				t.Errorf("validatePatch() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"backend/auth"
+	"backend/models"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxTagLength is how long device tags can be at most.
+const maxTagLength = 64
+
+// HandleGetDeviceGroups lists the device groups of the fleet the request acts on, with the devices
+// of each group the user has access to.
+func (d *DeviceService) HandleGetDeviceGroups(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	groups, err := d.DB.GetDeviceGroups(auth.UserIDFromContext(r.Context()), orgID)
+	if err != nil {
+		http.Error(w, "Error fetching device groups: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	access, err := loadDeviceAccess(d.DB, r)
+	if err != nil {
+		http.Error(w, "Error fetching device access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range groups {
+		groups[i].DeviceIDs = slices.DeleteFunc(groups[i].DeviceIDs, func(deviceID string) bool {
+			return !access.canView(deviceID)
+		})
+	}
+
+	json.NewEncoder(w).Encode(groups)
+}
+
+// HandleCreateDeviceGroup creates a device group for the fleet the request acts on. Groups of an
+// organization's fleet can be managed by dispatchers and above.
+func (d *DeviceService) HandleCreateDeviceGroup(w http.ResponseWriter, r *http.Request, username string) {
+	if !requireFleetManager(w, r) {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		Name string `json:"name"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	if reqBody.Name == "" || len(reqBody.Name) > 255 {
+		http.Error(w, "Name must be between 1 and 255 characters long", http.StatusBadRequest)
+		return
+	}
+
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	groupID, err := d.DB.CreateDeviceGroup(auth.UserIDFromContext(r.Context()), orgID, reqBody.Name)
+	if err != nil {
+		http.Error(w, "Error creating device group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(models.DeviceGroup{ID: groupID, Name: reqBody.Name, DeviceIDs: []string{}})
+}
+
+// HandleDeleteDeviceGroup deletes a device group of the fleet the request acts on.
+func (d *DeviceService) HandleDeleteDeviceGroup(w http.ResponseWriter, r *http.Request, username string) {
+	if !requireFleetManager(w, r) {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		ID int `json:"id"`
+	}
+	if !decodeRequest(w, r, &reqBody) || !pathID(w, r, "id", &reqBody.ID) {
+		return
+	}
+
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	deleted, err := d.DB.DeleteDeviceGroup(auth.UserIDFromContext(r.Context()), orgID, reqBody.ID)
+	if err != nil {
+		http.Error(w, "Error deleting device group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Device group not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleUpdateDeviceGroup adds devices to and removes devices from a device group of the fleet the
+// request acts on. Restricted members of an organization need edit access to each of the devices.
+func (d *DeviceService) HandleUpdateDeviceGroup(w http.ResponseWriter, r *http.Request, username string) {
+	if !requireFleetManager(w, r) {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		ID     int      `json:"id"`
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	if !decodeRequest(w, r, &reqBody) || !pathID(w, r, "id", &reqBody.ID) {
+		return
+	}
+	if !d.requireEditAccess(w, r, append(slices.Clone(reqBody.Add), reqBody.Remove...)) {
+		return
+	}
+
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	updated, err := d.DB.UpdateDeviceGroup(
+		auth.UserIDFromContext(r.Context()),
+		orgID,
+		reqBody.ID,
+		reqBody.Add,
+		reqBody.Remove,
+	)
+	if err != nil {
+		http.Error(w, "Error updating device group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "Device group not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleUpdateDeviceGroupSettings hides or shows all devices of a device group, sets their color, or
+// both, in one transaction. Like /hide-device and /change-color, it changes the user's own settings,
+// and only for the devices of the group the user has access to. The patch of each device is
+// validated like those of a batch.
+func (d *DeviceService) HandleUpdateDeviceGroupSettings(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		ID    int     `json:"id"`
+		Hide  *bool   `json:"hide"`
+		Color *string `json:"color"`
+	}
+	if !decodeRequest(w, r, &reqBody) || !pathID(w, r, "id", &reqBody.ID) {
+		return
+	}
+	if reqBody.Hide == nil && reqBody.Color == nil {
+		http.Error(w, "At least one of hide and color must be set", http.StatusBadRequest)
+		return
+	}
+
+	userID := auth.UserIDFromContext(r.Context())
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	deviceIDs, err := d.DB.GetDeviceGroupDevices(userID, orgID, reqBody.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Device group not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error fetching device group: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	access, err := loadDeviceAccess(d.DB, r)
+	if err != nil {
+		http.Error(w, "Error fetching device access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var patches []models.DeviceSettingsPatch
+	for _, deviceID := range deviceIDs {
+		if access.canView(deviceID) {
+			patches = append(patches, models.DeviceSettingsPatch{
+				DeviceID: deviceID,
+				IsHidden: reqBody.Hide,
+				Color:    reqBody.Color,
+			})
+		}
+	}
+	if !respondWithPatchErrors(w, patches, access) {
+		return
+	}
+
+	err = d.DB.PatchDeviceSettings(userID, patches)
+	if err != nil {
+		http.Error(w, "Error updating device settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]int{"updated": len(patches)})
+}
+
+// HandleGetDeviceTags lists the tags of the devices of the fleet the request acts on that the user
+// has access to, keyed by device ID.
+func (d *DeviceService) HandleGetDeviceTags(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	tags, err := d.DB.GetDeviceTags(auth.UserIDFromContext(r.Context()), orgID)
+	if err != nil {
+		http.Error(w, "Error fetching device tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	access, err := loadDeviceAccess(d.DB, r)
+	if err != nil {
+		http.Error(w, "Error fetching device access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for deviceID := range tags {
+		if !access.canView(deviceID) {
+			delete(tags, deviceID)
+		}
+	}
+
+	json.NewEncoder(w).Encode(tags)
+}
+
+// HandleSetDeviceTags replaces the tags of a device of the fleet the request acts on. Tags are
+// free-form, up to 64 characters long, and compared case-sensitively.
+func (d *DeviceService) HandleSetDeviceTags(w http.ResponseWriter, r *http.Request, username string) {
+	if !requireFleetManager(w, r) {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		DeviceID string   `json:"device_id"`
+		Tags     []string `json:"tags"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	pathValue(r, "id", &reqBody.DeviceID)
+	if reqBody.DeviceID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for i, tag := range reqBody.Tags {
+		reqBody.Tags[i] = strings.TrimSpace(tag)
+		if reqBody.Tags[i] == "" || len(reqBody.Tags[i]) > maxTagLength {
+			http.Error(w, "Tags must be between 1 and 64 characters long", http.StatusBadRequest)
+			return
+		}
+	}
+	slices.Sort(reqBody.Tags)
+	reqBody.Tags = slices.Compact(reqBody.Tags)
+	if !d.requireEditAccess(w, r, []string{reqBody.DeviceID}) {
+		return
+	}
+
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	err := d.DB.SetDeviceTags(
+		auth.UserIDFromContext(r.Context()),
+		orgID,
+		reqBody.DeviceID,
+		reqBody.Tags,
+	)
+	if err != nil {
+		http.Error(w, "Error updating device tags: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// selectDevices returns the devices selected by the group and tag query parameters of the request,
+// or nil if it selects none. With both, only devices that are in the group and have the tag are
+// selected. Unknown groups and tags select no devices.
+func (d *DeviceService) selectDevices(r *http.Request) ([]string, error) {
+	query := r.URL.Query()
+	if !query.Has("group") && !query.Has("tag") {
+		return nil, nil
+	}
+
+	userID := auth.UserIDFromContext(r.Context())
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	var selected []string
+	if query.Has("group") {
+		groupID, err := strconv.Atoi(query.Get("group"))
+		if err != nil {
+			return []string{}, nil
+		}
+		selected, err = d.DB.GetDeviceGroupDevices(userID, orgID, groupID)
+		if err == sql.ErrNoRows {
+			return []string{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if query.Has("tag") {
+		tagged, err := d.DB.GetTaggedDevices(userID, orgID, query.Get("tag"))
+		if err != nil {
+			return nil, err
+		}
+		if selected == nil {
+			return tagged, nil
+		}
+		selected = slices.DeleteFunc(selected, func(deviceID string) bool {
+			return !slices.Contains(tagged, deviceID)
+		})
+	}
+	return selected, nil
+}
+
+// requireEditAccess checks that the user making the request may edit the devices for the
+// organization, and responds with an error if not.
+func (d *DeviceService) requireEditAccess(w http.ResponseWriter, r *http.Request, deviceIDs []string) bool {
+	access, err := loadDeviceAccess(d.DB, r)
+	if err != nil {
+		http.Error(w, "Error fetching device access: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	for _, deviceID := range deviceIDs {
+		if !access.canEdit(deviceID) {
+			http.Error(w, "No edit access to device "+deviceID, http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// requireFleetManager checks that the user making the request may manage the device groups and tags
+// of the fleet it acts on, and responds with an error if not. Users manage their own fleet, and
+// dispatchers and above the fleet of their organization.
+func requireFleetManager(w http.ResponseWriter, r *http.Request) bool {
+	if orgID, _ := auth.OrganizationFromContext(r.Context()); orgID == 0 {
+		return true
+	}
+	_, ok := requireRole(w, r, auth.RoleDispatcher)
+	return ok
+}
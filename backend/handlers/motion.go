@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"backend/models"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// stationarySpeed is the speed in km/h below which a device is treated as stationary and its
+	// position is not extrapolated.
+	stationarySpeed = 2.0
+
+	// maxFixAge is how long after its last fix a device's position may be extrapolated. Past this,
+	// the fix is stale and the device is shown where it was last seen.
+	maxFixAge = 2 * time.Minute
+
+	// earthRadius is the mean radius of the Earth in metres.
+	earthRadius = 6371008.8
+)
+
+// estimateVelocity derives the velocity of a device from the speed (in km/h, as reported by the
+// OneStepGPS API) and heading of its latest point. It returns nil if the device is stationary,
+// the fix time is unknown or the fix is already stale at the given time.
+func estimateVelocity(speed float64, angle float64, dtTracker string, now time.Time) *models.Velocity {
+	if speed < stationarySpeed {
+		return nil
+	}
+	fixTime, err := time.Parse(time.RFC3339, dtTracker)
+	if err != nil {
+		return nil
+	}
+	validUntil := fixTime.Add(maxFixAge)
+	if now.After(validUntil) {
+		return nil
+	}
+
+	metresPerSecond := speed * 1000 / 3600
+	heading := angle * math.Pi / 180
+	return &models.Velocity{
+		North:      metresPerSecond * math.Cos(heading),
+		East:       metresPerSecond * math.Sin(heading),
+		FixTime:    fixTime,
+		ValidUntil: validUntil,
+	}
+}
+
+// predictPosition moves the device along its velocity to its expected position at the given time.
+// The extrapolation is clamped to the velocity's validity window, so a device never moves before
+// its last fix or after the fix has gone stale.
+func predictPosition(device *models.Device, at time.Time) {
+	v := device.Velocity
+	if v == nil {
+		return
+	}
+	if at.After(v.ValidUntil) {
+		at = v.ValidUntil
+	}
+	elapsed := at.Sub(v.FixTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	lat := device.Latitude * math.Pi / 180
+	device.Latitude += v.North * elapsed / earthRadius * 180 / math.Pi
+	device.Longitude += v.East * elapsed / (earthRadius * math.Cos(lat)) * 180 / math.Pi
+}
+
+// parsePredictAt reads the optional predict_at query parameter. It returns the zero time if the
+// parameter is absent.
+func parsePredictAt(r *http.Request) (time.Time, error) {
+	predictAt := r.URL.Query().Get("predict_at")
+	if predictAt == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, predictAt)
+}
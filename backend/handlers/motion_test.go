@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"backend/models"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEstimateVelocity(t *testing.T) {
+	fix := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fixTime := fix.Format(time.RFC3339)
+	tests := []struct {
+		name      string
+		speed     float64
+		angle     float64
+		dtTracker string
+		now       time.Time
+		north     float64
+		east      float64
+		ok        bool
+	}{
+		{"heading north", 36, 0, fixTime, fix, 10, 0, true},
+		{"heading east", 36, 90, fixTime, fix, 0, 10, true},
+		{"heading south west", 72, 225, fixTime, fix, -10 * math.Sqrt2, -10 * math.Sqrt2, true},
+		{"just before the fix is stale", 36, 0, fixTime, fix.Add(maxFixAge), 10, 0, true},
+		{"stationary", stationarySpeed - 0.1, 0, fixTime, fix, 0, 0, false},
+		{"stale fix", 36, 0, fixTime, fix.Add(maxFixAge + time.Second), 0, 0, false},
+		{"unknown fix time", 36, 0, "", fix, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := estimateVelocity(test.speed, test.angle, test.dtTracker, test.now)
+			if (v != nil) != test.ok {
+				t.Fatalf("estimateVelocity() = %+v, want a velocity %v", v, test.ok)
+			}
+			if v == nil {
+				return
+			}
+			if math.Abs(v.North-test.north) > 1e-9 || math.Abs(v.East-test.east) > 1e-9 {
+				t.Errorf("velocity = (%f, %f), want (%f, %f)", v.North, v.East, test.north, test.east)
+			}
+			if !v.FixTime.Equal(fix) || !v.ValidUntil.Equal(fix.Add(maxFixAge)) {
+				t.Errorf("valid from %v until %v, want from %v for %v", v.FixTime, v.ValidUntil, fix, maxFixAge)
+			}
+		})
+	}
+}
+
+func TestPredictPosition(t *testing.T) {
+	fix := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// One degree of latitude along a meridian, in metres
+	degree := earthRadius * math.Pi / 180
+	velocity := &models.Velocity{
+		North:      degree / 60,
+		East:       degree / 60,
+		FixTime:    fix,
+		ValidUntil: fix.Add(maxFixAge),
+	}
+	tests := []struct {
+		name     string
+		velocity *models.Velocity
+		at       time.Time
+		lat      float64
+		lng      float64
+	}{
+		{"after a minute", velocity, fix.Add(time.Minute), 1, 2},
+		{"after the fix went stale", velocity, fix.Add(time.Hour), 2, 4},
+		{"at the fix", velocity, fix, 0, 0},
+		{"before the fix", velocity, fix.Add(-time.Minute), 0, 0},
+		{"stationary", nil, fix.Add(time.Minute), 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// At 60 degrees of latitude a degree of longitude is half as long as at the equator
+			device := models.Device{Latitude: 60, Longitude: 10, Velocity: test.velocity}
+			predictPosition(&device, test.at)
+			lat, lng := device.Latitude-60, device.Longitude-10
+			if math.Abs(lat-test.lat) > 1e-9 || math.Abs(lng-test.lng) > 1e-9 {
+				t.Errorf("moved by (%f, %f), want (%f, %f)", lat, lng, test.lat, test.lng)
+			}
+		})
+	}
+}
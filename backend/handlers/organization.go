@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"backend/auth"
+	"backend/db"
+	"backend/models"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type OrganizationService struct {
+	DB *db.DB
+}
+
+func NewOrganizationService(db *db.DB) (*OrganizationService, error) {
+	if db == nil {
+		return nil, errors.New("db cannot be nil")
+	}
+	return &OrganizationService{DB: db}, nil
+}
+
+// HandleGetOrganizations lists the organizations the user is a member of and their role in each.
+func (o *OrganizationService) HandleGetOrganizations(w http.ResponseWriter, r *http.Request, username string) {
+	organizations, err := o.DB.GetOrganizations(auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error fetching organizations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(organizations)
+}
+
+// HandleCreateOrganization creates an organization with the user as its owner.
+func (o *OrganizationService) HandleCreateOrganization(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Name string `json:"name"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	if reqBody.Name == "" || len(reqBody.Name) > 255 {
+		http.Error(w, "Name must be between 1 and 255 characters long", http.StatusBadRequest)
+		return
+	}
+
+	orgID, err := o.DB.CreateOrganization(reqBody.Name, auth.UserIDFromContext(r.Context()))
+	if err != nil {
+		http.Error(w, "Error creating organization: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(models.Organization{
+		ID:   orgID,
+		Name: reqBody.Name,
+		Role: string(auth.RoleOwner),
+	})
+}
+
+// HandleGetMembers lists the members of the organization the request acts in.
+func (o *OrganizationService) HandleGetMembers(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleViewer)
+	if !ok {
+		return
+	}
+
+	members, err := o.DB.GetMembers(orgID)
+	if err != nil {
+		http.Error(w, "Error fetching members: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(members)
+}
+
+// HandleSetMember adds a user to the organization the request acts in or changes their role, and
+// whether they are restricted to the devices granted to them if the request says so. Admins can
+// manage dispatchers and viewers, only owners can manage admins and owners.
+func (o *OrganizationService) HandleSetMember(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		Username   string    `json:"username"`
+		Role       auth.Role `json:"role"`
+		Restricted *bool     `json:"restricted"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	pathValue(r, "username", &reqBody.Username)
+	if !reqBody.Role.Valid() {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	// Fetch the user and their current role
+	member, err := o.DB.GetUserByUsername(reqBody.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	currentRole, err := o.DB.GetMemberRole(orgID, member.ID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Error fetching member: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check that the user may make the change
+	if !o.canManage(r, auth.Role(currentRole), reqBody.Role) {
+		http.Error(w, "Only owners can manage admins and owners", http.StatusForbidden)
+		return
+	}
+	if auth.Role(currentRole) == auth.RoleOwner && reqBody.Role != auth.RoleOwner {
+		ok, err := o.keepsAnOwner(orgID)
+		if err != nil {
+			http.Error(w, "Error fetching members: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "An organization must have an owner", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = o.DB.SetMemberRole(orgID, member.ID, string(reqBody.Role), reqBody.Restricted)
+	if err != nil {
+		http.Error(w, "Error updating member: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleRemoveMember removes a user from the organization the request acts in. Every member can
+// leave an organization, removing others needs the same role as changing their role.
+func (o *OrganizationService) HandleRemoveMember(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleViewer)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var reqBody struct {
+		Username string `json:"username"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	pathValue(r, "username", &reqBody.Username)
+
+	// Fetch the member
+	member, err := o.DB.GetUserByUsername(reqBody.Username)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	memberRole, err := o.DB.GetMemberRole(orgID, member.ID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error fetching member: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Check that the user may remove the member
+	_, role := auth.OrganizationFromContext(r.Context())
+	if member.ID != auth.UserIDFromContext(r.Context()) {
+		if !role.AtLeast(auth.RoleAdmin) {
+			http.Error(w, "Insufficient role", http.StatusForbidden)
+			return
+		}
+		if !o.canManage(r, auth.Role(memberRole), auth.RoleViewer) {
+			http.Error(w, "Only owners can manage admins and owners", http.StatusForbidden)
+			return
+		}
+	}
+	if auth.Role(memberRole) == auth.RoleOwner {
+		ok, err := o.keepsAnOwner(orgID)
+		if err != nil {
+			http.Error(w, "Error fetching members: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "An organization must have an owner", http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, err = o.DB.RemoveMember(orgID, member.ID)
+	if err != nil {
+		http.Error(w, "Error removing member: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleGetDeviceDefaults lists the default device settings of the organization the request acts
+// in, for the devices the user has access to.
+func (o *OrganizationService) HandleGetDeviceDefaults(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleViewer)
+	if !ok {
+		return
+	}
+
+	defaults, err := o.DB.GetDeviceDefaults(orgID)
+	if err != nil {
+		http.Error(w, "Error fetching device defaults: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	access, err := loadDeviceAccess(o.DB, r)
+	if err != nil {
+		http.Error(w, "Error fetching device access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	visible := []models.DeviceDefaults{}
+	for _, deviceDefaults := range defaults {
+		if access.canView(deviceDefaults.DeviceID) {
+			visible = append(visible, deviceDefaults)
+		}
+	}
+
+	json.NewEncoder(w).Encode(visible)
+}
+
+// HandleSetDeviceDefaults sets the organization's default settings for a device. Fields left out
+// of the request keep their current value, and members' own settings take precedence. Restricted
+// members need an edit grant for the device.
+func (o *OrganizationService) HandleSetDeviceDefaults(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, ok := requireRole(w, r, auth.RoleDispatcher)
+	if !ok {
+		return
+	}
+
+	// Parse and validate the request body
+	var defaults models.DeviceDefaults
+	if !decodeRequest(w, r, &defaults) {
+		return
+	}
+	pathValue(r, "id", &defaults.DeviceID)
+	if defaults.DeviceID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	access, err := loadDeviceAccess(o.DB, r)
+	if err != nil {
+		http.Error(w, "Error fetching device access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !access.canEdit(defaults.DeviceID) {
+		http.Error(w, "No edit access to the device", http.StatusForbidden)
+		return
+	}
+
+	err = o.DB.SetDeviceDefaults(orgID, defaults)
+	if err != nil {
+		http.Error(w, "Error updating device defaults: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// canManage reports whether the user making the request may change a member's role from one role
+// to another. Only owners can change the role of admins and owners or make someone one.
+func (o *OrganizationService) canManage(r *http.Request, from auth.Role, to auth.Role) bool {
+	_, role := auth.OrganizationFromContext(r.Context())
+	if from.AtLeast(auth.RoleAdmin) || to.AtLeast(auth.RoleAdmin) {
+		return role == auth.RoleOwner
+	}
+	return role.AtLeast(auth.RoleAdmin)
+}
+
+// keepsAnOwner reports whether the organization still has an owner after one of its owners leaves
+// or is demoted.
+func (o *OrganizationService) keepsAnOwner(orgID int) (bool, error) {
+	owners, err := o.DB.CountOwners(orgID)
+	return owners > 1, err
+}
+
+// requireRole checks that the request acts in an organization in which the user has at least the
+// given role, and responds with an error if not. It returns the organization's ID.
+func requireRole(w http.ResponseWriter, r *http.Request, min auth.Role) (int, bool) {
+	orgID, role := auth.OrganizationFromContext(r.Context())
+	if orgID == 0 {
+		http.Error(w, "No organization selected, set the "+auth.OrganizationHeader+" header", http.StatusBadRequest)
+		return 0, false
+	}
+	if !role.AtLeast(min) {
+		http.Error(w, "Insufficient role", http.StatusForbidden)
+		return 0, false
+	}
+	return orgID, true
+}
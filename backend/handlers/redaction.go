@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"backend/auth"
+	"backend/models"
+	"math"
+)
+
+// redactDevice hides the fields of a device that the redaction of an anonymous request doesn't
+// allow it to see. Rounding the coordinates also drops the velocity, since extrapolating from it
+// would reveal the device's movement within the rounded area.
+func redactDevice(device *models.Device, redaction *auth.Redaction) {
+	if redaction == nil {
+		return
+	}
+
+	if redaction.CoordinatePrecision >= 0 {
+		scale := math.Pow(10, float64(redaction.CoordinatePrecision))
+		device.Latitude = math.Round(device.Latitude*scale) / scale
+		device.Longitude = math.Round(device.Longitude*scale) / scale
+		device.Velocity = nil
+	}
+	if redaction.Fields["display_name"] {
+		device.DisplayName = ""
+	}
+	if redaction.Fields["nickname"] {
+		device.Nickname = ""
+	}
+	if redaction.Fields["altitude"] {
+		device.Altitude = 0
+	}
+	if redaction.Fields["angle"] {
+		device.Angle = 0
+	}
+	if redaction.Fields["speed"] {
+		device.Speed = 0
+	}
+	if redaction.Fields["velocity"] {
+		device.Velocity = nil
+	}
+}
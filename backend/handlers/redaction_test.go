@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"backend/auth"
+	"backend/models"
+	"testing"
+	"time"
+)
+
+func TestRedactDevice(t *testing.T) {
+	newDevice := func() models.Device {
+		return models.Device{
+			DeviceID:    "a",
+			DisplayName: "Truck",
+			Latitude:    52.520008,
+			Longitude:   13.404954,
+			Altitude:    34,
+			Angle:       90,
+			Speed:       50,
+			Velocity:    &models.Velocity{North: 1, ValidUntil: time.Now()},
+			Color:       "#112233",
+			Nickname:    "Blue truck",
+		}
+	}
+
+	tests := []struct {
+		name      string
+		redaction *auth.Redaction
+		want      func(*models.Device)
+	}{
+		{"no redaction", nil, func(*models.Device) {}},
+		{
+			"nothing redacted",
+			&auth.Redaction{CoordinatePrecision: -1, Fields: map[string]bool{}},
+			func(*models.Device) {},
+		},
+		{
+			"rounded coordinates",
+			&auth.Redaction{CoordinatePrecision: 2, Fields: map[string]bool{}},
+			func(d *models.Device) {
+				d.Latitude, d.Longitude, d.Velocity = 52.52, 13.4, nil
+			},
+		},
+		{
+			"coordinates rounded to degrees",
+			&auth.Redaction{CoordinatePrecision: 0, Fields: map[string]bool{}},
+			func(d *models.Device) {
+				d.Latitude, d.Longitude, d.Velocity = 53, 13, nil
+			},
+		},
+		{
+			"every field",
+			&auth.Redaction{
+				CoordinatePrecision: -1,
+				Fields: map[string]bool{
+					"display_name": true,
+					"nickname":     true,
+					"altitude":     true,
+					"angle":        true,
+					"speed":        true,
+					"velocity":     true,
+				},
+			},
+			func(d *models.Device) {
+				d.DisplayName, d.Nickname, d.Altitude, d.Angle, d.Speed, d.Velocity = "", "", 0, 0, 0, nil
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := newDevice()
+			redactDevice(&device, test.redaction)
+			want := newDevice()
+			test.want(&want)
+			if (device.Velocity == nil) != (want.Velocity == nil) {
+				t.Errorf("Velocity = %+v, want %+v", device.Velocity, want.Velocity)
+			}
+			device.Velocity, want.Velocity = nil, nil
+			if device != want {
+				t.Errorf("redactDevice() = %+v, want %+v", device, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// versionedAPIPrefix is the path prefix of the routes of version 1 of the REST API.
+const versionedAPIPrefix = "/api/v1/"
+
+// decodeRequest parses the JSON body of a request into the typed request struct v, and responds
+// with an error if it is invalid. Routes of the versioned API reject unknown fields, so a misspelled
+// field isn't silently ignored, and accept an empty body, since they name the resource they act on
+// in the path.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	versioned := strings.HasPrefix(r.URL.Path, versionedAPIPrefix)
+	decoder := json.NewDecoder(r.Body)
+	if versioned {
+		decoder.DisallowUnknownFields()
+	}
+	err := decoder.Decode(v)
+	if err == io.EOF && versioned {
+		return true
+	}
+	if err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// pathID sets id to the number in the {name} wildcard of the request's path, if its route has one,
+// and responds with an error if it isn't a number. The deprecated routes take the ID from the body.
+func pathID(w http.ResponseWriter, r *http.Request, name string, id *int) bool {
+	value := r.PathValue(name)
+	if value == "" {
+		return true
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		http.Error(w, "Invalid "+name, http.StatusBadRequest)
+		return false
+	}
+	*id = parsed
+	return true
+}
+
+// pathValue sets value to the {name} wildcard of the request's path, if its route has one.
+func pathValue(r *http.Request, name string, value *string) {
+	if r.PathValue(name) != "" {
+		*value = r.PathValue(name)
+	}
+}
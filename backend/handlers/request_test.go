@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		body string
+		ok   bool
+		id   int
+	}{
+		{"deprecated route", "/device-groups/delete", `{"id":4}`, true, 4},
+		{"deprecated route with an unknown field", "/device-groups/delete", `{"id":4,"x":1}`, true, 4},
+		{"deprecated route without a body", "/device-groups/delete", ``, false, 0},
+		{"versioned route", "/api/v1/device-groups/4", `{"id":4}`, true, 4},
+		{"versioned route with an unknown field", "/api/v1/device-groups/4", `{"x":1}`, false, 0},
+		{"versioned route without a body", "/api/v1/device-groups/4", ``, true, 0},
+		{"invalid JSON", "/api/v1/device-groups/4", `{`, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			var reqBody struct {
+				ID int `json:"id"`
+			}
+			ok := decodeRequest(w, r, &reqBody)
+			if ok != test.ok {
+				t.Fatalf("decodeRequest() = %v, want %v", ok, test.ok)
+			}
+			if ok && reqBody.ID != test.id {
+				t.Errorf("ID = %d, want %d", reqBody.ID, test.id)
+			}
+			if !ok && w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestPathID(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+		want  int
+	}{
+		{"no wildcard", "", true, 7},
+		{"number", "12", true, 12},
+		{"not a number", "abc", false, 7},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/", nil)
+			r.SetPathValue("id", test.value)
+			w := httptest.NewRecorder()
+			id := 7
+			ok := pathID(w, r, "id", &id)
+			if ok != test.ok || id != test.want {
+				t.Errorf("pathID() = %v with id %d, want %v with id %d", ok, id, test.ok, test.want)
+			}
+		})
+	}
+}
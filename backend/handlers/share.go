@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"backend/auth"
+	"backend/models"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// maxShareLinkHours is how long share links can be valid at most.
+	maxShareLinkHours = 30 * 24
+	// maxShareLinkDevices is how many devices a share link can show at most.
+	maxShareLinkDevices = 50
+	// sharedDevicesTTL is how long the devices of a share link are served from memory before they
+	// are fetched from OneStepGPS again.
+	sharedDevicesTTL = 10 * time.Second
+)
+
+// sharedDevicesCache holds the devices of recently viewed share links, keyed by link ID, along with
+// the views served from memory. Those views are counted when the link's devices are fetched again,
+// or with the next fetch of any link once they are stale, so a busy link causes one upstream fetch
+// and one database write per sharedDevicesTTL.
+type sharedDevicesCache struct {
+	mu      sync.Mutex
+	entries map[int]*sharedDevicesEntry
+}
+
+type sharedDevicesEntry struct {
+	devices   []models.Device
+	fetchedAt time.Time
+	views     models.ShareLinkViews
+}
+
+func newSharedDevicesCache() *sharedDevicesCache {
+	return &sharedDevicesCache{entries: make(map[int]*sharedDevicesEntry)}
+}
+
+// get returns the devices of the share link if they were fetched less than sharedDevicesTTL ago,
+// and adds the view to those yet to be counted.
+func (c *sharedDevicesCache) get(linkID int, now time.Time) ([]models.Device, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[linkID]
+	if !ok || now.Sub(entry.fetchedAt) >= sharedDevicesTTL {
+		return nil, false
+	}
+	entry.views.Count++
+	entry.views.LastViewedAt = now
+	return entry.devices, true
+}
+
+// put stores the freshly fetched devices of the share link for a view at the given time. It drops
+// the stale entries and returns the views to count: this one and those served from the dropped
+// entries.
+func (c *sharedDevicesCache) put(linkID int, devices []models.Device, now time.Time) []models.ShareLinkViews {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	views := []models.ShareLinkViews{{LinkID: linkID, Count: 1, LastViewedAt: now}}
+	for id, entry := range c.entries {
+		if now.Sub(entry.fetchedAt) < sharedDevicesTTL {
+			continue
+		}
+		if id == linkID {
+			views[0].Count += entry.views.Count
+		} else if entry.views.Count > 0 {
+			views = append(views, entry.views)
+		}
+		delete(c.entries, id)
+	}
+	c.entries[linkID] = &sharedDevicesEntry{
+		devices:   devices,
+		fetchedAt: now,
+		views:     models.ShareLinkViews{LinkID: linkID},
+	}
+	return views
+}
+
+// HandleGetShareLinks lists the share links the user created for the fleet the request acts on.
+func (d *DeviceService) HandleGetShareLinks(w http.ResponseWriter, r *http.Request, username string) {
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	links, err := d.DB.GetShareLinks(auth.UserIDFromContext(r.Context()), orgID)
+	if err != nil {
+		http.Error(w, "Error fetching share links: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(links)
+}
+
+// HandleCreateShareLink creates a link that shows the live location of some devices of the fleet
+// the request acts on to anyone who has it, until it expires after the given number of hours. If a
+// window is given, the link only shows the devices within it. The token is only part of this
+// response, only its hash is stored. The global fleet cannot be shared, since its route policy
+// decides what anonymous viewers see of it.
+func (d *DeviceService) HandleCreateShareLink(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		Name           string     `json:"name"`
+		DeviceIDs      []string   `json:"device_ids"`
+		ExpiresInHours int        `json:"expires_in_hours"`
+		WindowStart    *time.Time `json:"window_start"`
+		WindowEnd      *time.Time `json:"window_end"`
+	}
+	if !decodeRequest(w, r, &reqBody) {
+		return
+	}
+	if reqBody.Name == "" || len(reqBody.Name) > 255 {
+		http.Error(w, "Name must be between 1 and 255 characters long", http.StatusBadRequest)
+		return
+	}
+	slices.Sort(reqBody.DeviceIDs)
+	reqBody.DeviceIDs = slices.Compact(reqBody.DeviceIDs)
+	if len(reqBody.DeviceIDs) == 0 || len(reqBody.DeviceIDs) > maxShareLinkDevices {
+		http.Error(w, "Share links must show between 1 and 50 devices", http.StatusBadRequest)
+		return
+	}
+	if reqBody.ExpiresInHours < 1 || reqBody.ExpiresInHours > maxShareLinkHours {
+		http.Error(w, "expires_in_hours must be between 1 and 720", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if reqBody.WindowStart != nil && reqBody.WindowEnd != nil &&
+		!reqBody.WindowEnd.After(*reqBody.WindowStart) {
+		http.Error(w, "window_end must be after window_start", http.StatusBadRequest)
+		return
+	}
+	if reqBody.WindowEnd != nil && !reqBody.WindowEnd.After(now) {
+		http.Error(w, "window_end must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	// Only devices of the user's own or their organization's fleet that they have access to can be
+	// shared
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	global, err := d.usesGlobalFleet(auth.UserIDFromContext(r.Context()), orgID)
+	if err != nil {
+		http.Error(w, "Error fetching credentials: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if global {
+		http.Error(w, "The global fleet cannot be shared, register your own OneStepGPS API key", http.StatusBadRequest)
+		return
+	}
+	devices, err := d.fetchVisibleDevices(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, deviceID := range reqBody.DeviceIDs {
+		found := slices.ContainsFunc(devices, func(device models.DeviceResponse) bool {
+			return device.DeviceID == deviceID
+		})
+		if !found {
+			http.Error(w, "Unknown device "+deviceID, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Create the link
+	token, tokenHash, err := auth.NewShareToken()
+	if err != nil {
+		http.Error(w, "Error creating share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	link := models.ShareLink{
+		UserID:      auth.UserIDFromContext(r.Context()),
+		Name:        reqBody.Name,
+		DeviceIDs:   reqBody.DeviceIDs,
+		WindowStart: reqBody.WindowStart,
+		WindowEnd:   reqBody.WindowEnd,
+		ExpiresAt:   now.Add(time.Duration(reqBody.ExpiresInHours) * time.Hour),
+		CreatedAt:   now,
+	}
+	if orgID != 0 {
+		link.OrganizationID = &orgID
+	}
+	link.ID, err = d.DB.AddShareLink(link, tokenHash)
+	if err != nil {
+		http.Error(w, "Error storing share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		models.ShareLink
+		Token string `json:"token"`
+	}{link, token})
+}
+
+// HandleRevokeShareLink revokes one of the user's share links.
+func (d *DeviceService) HandleRevokeShareLink(w http.ResponseWriter, r *http.Request, username string) {
+	// Parse and validate the request body
+	var reqBody struct {
+		ID int `json:"id"`
+	}
+	if !decodeRequest(w, r, &reqBody) || !pathID(w, r, "id", &reqBody.ID) {
+		return
+	}
+
+	revoked, err := d.DB.RevokeShareLink(auth.UserIDFromContext(r.Context()), reqBody.ID)
+	if err != nil {
+		http.Error(w, "Error revoking share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Operation successful"})
+}
+
+// HandleGetSharedDevices serves the live location of the devices of the share link with the token in
+// the /shared/{token} path, and counts the view. There is no recent trail, since no location
+// history is stored. The devices are limited to those that the link's
+// creator still has access to, and links of creators that left their organization or removed their
+// own OneStepGPS API key stop working. Revoked and expired links stop working right away, while
+// the devices are served from sharedDevicesCache for up to sharedDevicesTTL.
+func (d *DeviceService) HandleGetSharedDevices(w http.ResponseWriter, r *http.Request) {
+	link, err := d.DB.GetActiveShareLink(auth.HashShareToken(r.PathValue("token")))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Share link not found or expired", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Error fetching share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	if (link.WindowStart != nil && now.Before(*link.WindowStart)) ||
+		(link.WindowEnd != nil && !now.Before(*link.WindowEnd)) {
+		http.Error(w, "Share link is not active at this time", http.StatusForbidden)
+		return
+	}
+	shared := models.SharedDevices{Name: link.Name, ExpiresAt: link.ExpiresAt}
+	if devices, ok := d.shared.get(link.ID, now); ok {
+		shared.Devices = devices
+		respondWithSharedDevices(w, shared)
+		return
+	}
+
+	// Check what the creator of the link can still see
+	orgID := 0
+	var role auth.Role
+	if link.OrganizationID != nil {
+		orgID = *link.OrganizationID
+		memberRole, err := d.DB.GetMemberRole(orgID, link.UserID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Share link not found or expired", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Error fetching share link: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		role = auth.Role(memberRole)
+	}
+	global, err := d.usesGlobalFleet(link.UserID, orgID)
+	if err != nil {
+		http.Error(w, "Error fetching share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if global {
+		http.Error(w, "Share link not found or expired", http.StatusNotFound)
+		return
+	}
+	access, err := loadMemberDeviceAccess(d.DB, orgID, link.UserID, role)
+	if err != nil {
+		http.Error(w, "Error fetching share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Anyone with the link gets this response, so errors are only logged
+	apiResponse, err := d.fetchFleet(link.UserID, orgID)
+	if err != nil {
+		log.Printf("Error fetching devices of share link %d: %v", link.ID, err)
+		http.Error(w, errOneStepGPS.Error(), http.StatusInternalServerError)
+		return
+	}
+	shared.Devices = []models.Device{}
+	for _, device := range apiResponse.ResultList {
+		if !slices.Contains(link.DeviceIDs, device.DeviceID) || !access.canView(device.DeviceID) {
+			continue
+		}
+		shared.Devices = append(shared.Devices, models.Device{
+			DeviceID:    device.DeviceID,
+			DisplayName: device.DisplayName,
+			Latitude:    device.LatestDevicePoint.Latitude,
+			Longitude:   device.LatestDevicePoint.Longitude,
+			Altitude:    device.LatestDevicePoint.Altitude,
+			Angle:       device.LatestDevicePoint.Angle,
+			Speed:       device.LatestDevicePoint.Speed,
+			Velocity: estimateVelocity(
+				device.LatestDevicePoint.Speed,
+				device.LatestDevicePoint.Angle,
+				device.LatestDevicePoint.DtTracker,
+				now,
+			),
+		})
+	}
+
+	err = d.DB.RecordShareLinkViews(d.shared.put(link.ID, shared.Devices, now))
+	if err != nil {
+		http.Error(w, "Error recording view: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	respondWithSharedDevices(w, shared)
+}
+
+func respondWithSharedDevices(w http.ResponseWriter, shared models.SharedDevices) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(shared)
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"backend/models"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSharedDevicesCache(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	devices := []models.Device{{DeviceID: "a"}}
+	c := newSharedDevicesCache()
+
+	views := c.put(1, devices, start)
+	want := []models.ShareLinkViews{{LinkID: 1, Count: 1, LastViewedAt: start}}
+	if !slices.Equal(views, want) {
+		t.Fatalf("put() = %v, want %v", views, want)
+	}
+	c.put(2, devices, start)
+
+	tests := []struct {
+		name string
+		at   time.Duration
+		ok   bool
+	}{
+		{"fresh", time.Second, true},
+		{"still fresh", sharedDevicesTTL - time.Second, true},
+		{"stale", sharedDevicesTTL, false},
+	}
+	for _, test := range tests {
+		got, ok := c.get(1, start.Add(test.at))
+		if ok != test.ok {
+			t.Errorf("%s: get() ok = %v, want %v", test.name, ok, test.ok)
+		}
+		if ok && len(got) != len(devices) {
+			t.Errorf("%s: get() = %v, want %v", test.name, got, devices)
+		}
+	}
+
+	// The views served from memory are counted with the next fetch, along with those of other
+	// stale links
+	c.get(2, start.Add(time.Second))
+	refetched := start.Add(sharedDevicesTTL)
+	views = c.put(1, devices, refetched)
+	want = []models.ShareLinkViews{
+		{LinkID: 1, Count: 3, LastViewedAt: refetched},
+		{LinkID: 2, Count: 1, LastViewedAt: start.Add(time.Second)},
+	}
+	if !slices.Equal(views, want) {
+		t.Errorf("put() = %v, want %v", views, want)
+	}
+	if _, ok := c.get(2, refetched); ok {
+		t.Error("get() served a dropped link")
+	}
+}
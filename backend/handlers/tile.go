@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"backend/auth"
+	"backend/models"
+	"backend/mvt"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tileCacheSize is the maximum number of encoded tiles kept in memory before the cache is reset.
+const tileCacheSize = 4096
+
+// fleetSnapshotTTL is how long the devices of a fleet are reused for tiles before they are fetched
+// again. A map view requests many tiles at once, which would otherwise each fetch the fleet from
+// OneStepGPS. Changed settings show up in the tiles within this time.
+const fleetSnapshotTTL = 5 * time.Second
+
+// tileCache holds encoded vector tiles keyed by snapshot version and tile coordinates. A new
+// snapshot version produces new keys, so stale tiles are never served and are dropped once the
+// cache fills up.
+type tileCache struct {
+	mu    sync.Mutex
+	tiles map[string][]byte
+}
+
+func newTileCache() *tileCache {
+	return &tileCache{tiles: make(map[string][]byte)}
+}
+
+func (c *tileCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tile, ok := c.tiles[key]
+	return tile, ok
+}
+
+func (c *tileCache) put(key string, tile []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.tiles) >= tileCacheSize {
+		c.tiles = make(map[string][]byte)
+	}
+	c.tiles[key] = tile
+}
+
+// fleetSnapshotCache holds the devices with settings of recently tiled fleets, keyed by
+// fleetSnapshotKey.
+type fleetSnapshotCache struct {
+	mu        sync.Mutex
+	snapshots map[string]fleetSnapshot
+}
+
+type fleetSnapshot struct {
+	devices   []models.Device
+	fetchedAt time.Time
+}
+
+func newFleetSnapshotCache() *fleetSnapshotCache {
+	return &fleetSnapshotCache{snapshots: make(map[string]fleetSnapshot)}
+}
+
+// get returns the devices of the snapshot if it was fetched less than fleetSnapshotTTL ago.
+func (c *fleetSnapshotCache) get(key string, now time.Time) ([]models.Device, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot, ok := c.snapshots[key]
+	if !ok || now.Sub(snapshot.fetchedAt) >= fleetSnapshotTTL {
+		return nil, false
+	}
+	return snapshot.devices, true
+}
+
+// put stores a freshly fetched snapshot and drops the stale ones.
+func (c *fleetSnapshotCache) put(key string, devices []models.Device, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for other, snapshot := range c.snapshots {
+		if now.Sub(snapshot.fetchedAt) >= fleetSnapshotTTL {
+			delete(c.snapshots, other)
+		}
+	}
+	c.snapshots[key] = fleetSnapshot{devices: devices, fetchedAt: now}
+}
+
+// fleetSnapshotKey identifies what getDevicesWithSettings returns for a request: the devices of the
+// fleet it acts on that the user has access to, with the user's settings, narrowed down by the
+// group and tag query parameters.
+func fleetSnapshotKey(r *http.Request) string {
+	orgID, _ := auth.OrganizationFromContext(r.Context())
+	query := r.URL.Query()
+	return fmt.Sprintf(
+		"%d/%d/%t:%s/%t:%s",
+		auth.UserIDFromContext(r.Context()),
+		orgID,
+		query.Has("group"),
+		query.Get("group"),
+		query.Has("tag"),
+		query.Get("tag"),
+	)
+}
+
+// HandleGetTile serves the user's visible devices as a Mapbox Vector Tile for the tile in the
+// /tiles/{z}/{x}/{y}.mvt path. Each device is a point in the "devices" layer with its display
+// name, nickname, color and angle as attributes. The devices are fetched at most once per
+// fleetSnapshotTTL for all tiles of a fleet.
+func (d *DeviceService) HandleGetTile(w http.ResponseWriter, r *http.Request, username string) {
+	tile, err := parseTileID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID := auth.UserIDFromContext(r.Context())
+	now := time.Now()
+	snapshotKey := fleetSnapshotKey(r)
+	devices, ok := d.snapshots.get(snapshotKey, now)
+	if !ok {
+		devices, err = d.getDevicesWithSettings(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d.snapshots.put(snapshotKey, devices, now)
+	}
+
+	// The snapshot version changes whenever a position or setting of any device changes
+	version := snapshotVersion(userID, devices)
+	etag := `"` + version + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	key := fmt.Sprintf("%s/%d/%d/%d", version, tile.Z, tile.X, tile.Y)
+	encoded, ok := d.tiles.get(key)
+	if !ok {
+		encoded = encodeDeviceTile(tile, devices)
+		d.tiles.put(key, encoded)
+	}
+
+	w.Write(encoded)
+}
+
+// parseTileID reads the tile coordinates from the request path.
+func parseTileID(r *http.Request) (mvt.TileID, error) {
+	z, err := strconv.ParseUint(r.PathValue("z"), 10, 32)
+	if err != nil {
+		return mvt.TileID{}, fmt.Errorf("Invalid zoom level")
+	}
+	x, err := strconv.ParseUint(r.PathValue("x"), 10, 32)
+	if err != nil {
+		return mvt.TileID{}, fmt.Errorf("Invalid tile x coordinate")
+	}
+	y, err := strconv.ParseUint(strings.TrimSuffix(r.PathValue("y"), ".mvt"), 10, 32)
+	if err != nil {
+		return mvt.TileID{}, fmt.Errorf("Invalid tile y coordinate")
+	}
+
+	tile := mvt.TileID{Z: uint32(z), X: uint32(x), Y: uint32(y)}
+	if !tile.Valid() {
+		return mvt.TileID{}, fmt.Errorf("Tile coordinates out of range")
+	}
+	return tile, nil
+}
+
+// encodeDeviceTile encodes the visible devices that fall inside the tile.
+func encodeDeviceTile(tile mvt.TileID, devices []models.Device) []byte {
+	layer := mvt.Layer{Name: "devices"}
+	for _, device := range devices {
+		if device.IsHidden {
+			continue
+		}
+		x, y, ok := tile.Project(device.Latitude, device.Longitude)
+		if !ok {
+			continue
+		}
+		layer.Features = append(layer.Features, mvt.Feature{
+			X: x,
+			Y: y,
+			Properties: map[string]interface{}{
+				"device_id":    device.DeviceID,
+				"display_name": device.DisplayName,
+				"nickname":     device.Nickname,
+				"color":        device.Color,
+				"angle":        device.Angle,
+			},
+		})
+	}
+	return mvt.Encode([]mvt.Layer{layer})
+}
+
+// snapshotVersion hashes everything that ends up in a tile, so that two requests see the same
+// version exactly when they would produce the same tiles.
+func snapshotVersion(userID int, devices []models.Device) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\n", userID)
+	for _, device := range devices {
+		fmt.Fprintf(h, "%s|%s|%s|%s|%t|%v|%v|%v\n",
+			device.DeviceID,
+			device.DisplayName,
+			device.Nickname,
+			device.Color,
+			device.IsHidden,
+			device.Latitude,
+			device.Longitude,
+			device.Angle,
+		)
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"backend/models"
+	"backend/mvt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFleetSnapshotCache(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	devices := []models.Device{{DeviceID: "a"}}
+	c := newFleetSnapshotCache()
+	c.put("1/0/false:/false:", devices, start)
+	c.put("2/0/false:/false:", devices, start.Add(-fleetSnapshotTTL/2))
+
+	tests := []struct {
+		name string
+		key  string
+		at   time.Duration
+		ok   bool
+	}{
+		{"fresh", "1/0/false:/false:", time.Second, true},
+		{"still fresh", "1/0/false:/false:", fleetSnapshotTTL - time.Second, true},
+		{"stale", "1/0/false:/false:", fleetSnapshotTTL, false},
+		{"other fleet", "1/3/false:/false:", time.Second, false},
+		{"other user", "2/0/false:/false:", fleetSnapshotTTL / 2, false},
+	}
+	for _, test := range tests {
+		got, ok := c.get(test.key, start.Add(test.at))
+		if ok != test.ok {
+			t.Errorf("%s: get() ok = %v, want %v", test.name, ok, test.ok)
+		}
+		if ok && len(got) != len(devices) {
+			t.Errorf("%s: get() = %v, want %v", test.name, got, devices)
+		}
+	}
+
+	// Storing a snapshot drops the stale ones
+	c.put("3/0/false:/false:", devices, start.Add(fleetSnapshotTTL))
+	if len(c.snapshots) != 1 {
+		t.Errorf("%d snapshots kept, want 1", len(c.snapshots))
+	}
+}
+
+func TestParseTileID(t *testing.T) {
+	tests := []struct {
+		name    string
+		z       string
+		x       string
+		y       string
+		want    mvt.TileID
+		wantErr string
+	}{
+		{"root tile", "0", "0", "0.mvt", mvt.TileID{}, ""},
+		{"without extension", "3", "5", "2", mvt.TileID{Z: 3, X: 5, Y: 2}, ""},
+		{"last tile", "3", "7", "7.mvt", mvt.TileID{Z: 3, X: 7, Y: 7}, ""},
+		{"negative zoom", "-1", "0", "0.mvt", mvt.TileID{}, "Invalid zoom level"},
+		{"x not a number", "3", "a", "0.mvt", mvt.TileID{}, "Invalid tile x coordinate"},
+		{"other extension", "3", "0", "0.png", mvt.TileID{}, "Invalid tile y coordinate"},
+		{"x out of range", "3", "8", "0.mvt", mvt.TileID{}, "Tile coordinates out of range"},
+		{"zoom out of range", "31", "0", "0.mvt", mvt.TileID{}, "Tile coordinates out of range"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/tiles/z/x/y", nil)
+			r.SetPathValue("z", test.z)
+			r.SetPathValue("x", test.x)
+			r.SetPathValue("y", test.y)
+			tile, err := parseTileID(r)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("parseTileID() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tile != test.want {
+				t.Errorf("parseTileID() = %+v, want %+v", tile, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Package mailer sends transactional emails such as password reset links.
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+type Mailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+
+	// logOnly writes emails to the log instead of sending them.
+	logOnly bool
+}
+
+// NewMailer creates a mailer that sends emails through the given SMTP server.
+func NewMailer(host string, port string, username string, password string, from string) (*Mailer, error) {
+	if host == "" {
+		return nil, errors.New("SMTP host cannot be empty")
+	}
+	if from == "" {
+		return nil, errors.New("from address cannot be empty")
+	}
+	if port == "" {
+		port = "587"
+	}
+	return &Mailer{Host: host, Port: port, Username: username, Password: password, From: from}, nil
+}
+
+// NewLogMailer creates a mailer that writes emails to the log instead of sending them, which is
+// meant for local development. The log then contains the links of reset and verification emails.
+func NewLogMailer() *Mailer {
+	return &Mailer{logOnly: true}
+}
+
+// Send sends a plain text email to a single recipient.
+func (m *Mailer) Send(to string, subject string, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("invalid email header")
+	}
+	if m.logOnly {
+		log.Printf("Email to %s: %s\n%s", to, subject, body)
+		return nil
+	}
+
+	message := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n"+
+			"Content-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.From,
+		to,
+		subject,
+		time.Now().Format(time.RFC1123Z),
+		strings.ReplaceAll(body, "\n", "\r\n"),
+	)
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{to}, []byte(message))
+}
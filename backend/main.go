@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -9,7 +10,9 @@ import (
 	"backend/auth"
 	"backend/db"
 	"backend/handlers"
+	"backend/mailer"
 	"backend/models"
+	"backend/secrets"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
@@ -21,7 +24,38 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	authService, err := auth.NewAuthService([]byte("secret-key"), db)
+	keys, err := auth.LoadKeySet()
+	if err != nil {
+		log.Fatal(err)
+	}
+	passwords, err := auth.LoadPasswordPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var mail *mailer.Mailer
+	if os.Getenv("MAILER") == "log" {
+		mail = mailer.NewLogMailer()
+	} else {
+		mail, err = mailer.NewMailer(
+			os.Getenv("SMTP_HOST"),
+			os.Getenv("SMTP_PORT"),
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+			os.Getenv("SMTP_FROM"),
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	authService, err := auth.NewAuthService(keys, passwords, db, mail)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authService.WebAuthn, err = auth.LoadWebAuthn()
+	if err != nil {
+		log.Fatal(err)
+	}
+	authService.OIDC, err = auth.LoadOIDCProvider(context.Background())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -30,13 +64,43 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	deviceService.Secrets, err = secrets.LoadBox()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if deviceService.Secrets != nil {
+		resealed, failed, err := deviceService.ResealCredentials()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, err := range failed {
+			log.Printf("Error resealing OneStepGPS API key %v", err)
+		}
+		if resealed > 0 {
+			log.Printf("Resealed %d OneStepGPS API keys with key %s", resealed, os.Getenv("SECRETS_CURRENT_KEY"))
+		}
+	}
+
+	deviceLocationsPolicy, err := auth.LoadRoutePolicy("DEVICE_LOCATIONS")
+	if err != nil {
+		log.Fatal(err)
+	}
+	displayNamesPolicy, err := auth.LoadRoutePolicy("DISPLAY_NAMES")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	organizationService, err := handlers.NewOrganizationService(db)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	router := http.NewServeMux()
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
 		response := models.Response{Message: "Hello, World!"}
 		json.NewEncoder(w).Encode(response)
 	})
-	router.HandleFunc("/shields", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("GET /shields", func(w http.ResponseWriter, r *http.Request) {
 		response := map[string]interface{}{
 			"schemaVersion": 1,
 			"label":         "Fly.io",
@@ -46,36 +110,502 @@ func main() {
 		json.NewEncoder(w).Encode(response)
 	})
 
-	router.HandleFunc("/login", authService.HandleLogin)
-	router.HandleFunc("/signup", authService.HandleSignUp)
-	router.HandleFunc("/profile", authService.AuthMiddleware(authService.HandleGetProfile))
+	router.HandleFunc("GET /.well-known/jwks.json", keys.HandleGetJWKS)
+	router.HandleFunc("POST /login", authService.HandleLogin)
+	router.HandleFunc("POST /signup", authService.HandleSignUp)
+	router.HandleFunc("POST /login/2fa", authService.HandleLoginTOTP)
+	router.HandleFunc("POST /refresh", authService.HandleRefresh)
+	router.HandleFunc("POST /logout", authService.SessionAuthMiddleware(authService.HandleLogout))
+	router.HandleFunc("POST /logout-all", authService.SessionAuthMiddleware(authService.HandleLogoutAll))
+	router.HandleFunc(
+		"GET /profile",
+		deprecated("/api/v1/me", authService.AuthMiddleware(authService.HandleGetProfile)),
+	)
+	router.HandleFunc(
+		"POST /update-username",
+		authService.SessionAuthMiddleware(authService.HandleUpdateUsername),
+	)
+	router.HandleFunc(
+		"POST /change-password",
+		authService.SessionAuthMiddleware(authService.HandleChangePassword),
+	)
+	router.HandleFunc(
+		"POST /delete-account",
+		authService.SessionAuthMiddleware(authService.HandleDeleteAccount),
+	)
+	router.HandleFunc("POST /update-email", authService.SessionAuthMiddleware(authService.HandleUpdateEmail))
+	router.HandleFunc("POST /verify-email", authService.HandleVerifyEmail)
+	router.HandleFunc(
+		"POST /resend-verification",
+		authService.SessionAuthMiddleware(authService.HandleResendVerification),
+	)
+	router.HandleFunc("POST /forgot-password", authService.HandleForgotPassword)
+	router.HandleFunc("POST /reset-password", authService.HandleResetPassword)
+	router.HandleFunc("POST /2fa/enroll", authService.SessionAuthMiddleware(authService.HandleEnrollTOTP))
+	router.HandleFunc("POST /2fa/confirm", authService.SessionAuthMiddleware(authService.HandleConfirmTOTP))
+	router.HandleFunc("POST /2fa/disable", authService.SessionAuthMiddleware(authService.HandleDisableTOTP))
+	router.HandleFunc("GET /passkeys", authService.SessionAuthMiddleware(authService.HandleGetPasskeys))
+	router.HandleFunc(
+		"POST /passkeys/register/begin",
+		authService.SessionAuthMiddleware(authService.HandleBeginPasskeyRegistration),
+	)
+	router.HandleFunc(
+		"POST /passkeys/register/finish",
+		authService.SessionAuthMiddleware(authService.HandleFinishPasskeyRegistration),
+	)
+	router.HandleFunc(
+		"POST /passkeys/delete",
+		authService.SessionAuthMiddleware(authService.HandleDeletePasskey),
+	)
+	router.HandleFunc("POST /passkeys/login/begin", authService.HandleBeginPasskeyLogin)
+	router.HandleFunc("POST /passkeys/login/finish", authService.HandleFinishPasskeyLogin)
+	router.HandleFunc(
+		"GET /tokens",
+		deprecated("/api/v1/tokens", authService.SessionAuthMiddleware(authService.HandleGetAccessTokens)),
+	)
+	router.HandleFunc(
+		"POST /tokens/create",
+		deprecated("/api/v1/tokens", authService.SessionAuthMiddleware(authService.HandleCreateAccessToken)),
+	)
+	router.HandleFunc(
+		"POST /tokens/delete",
+		deprecated(
+			"/api/v1/tokens/{id}",
+			authService.SessionAuthMiddleware(authService.HandleDeleteAccessToken),
+		),
+	)
+	router.HandleFunc("GET /oidc/login", authService.HandleOIDCLogin)
+	router.HandleFunc("GET /oidc/callback", authService.HandleOIDCCallback)
+
+	displayNames := authService.PolicyMiddleware(
+		displayNamesPolicy,
+		auth.ScopeFleetRead,
+		deviceService.HandleGetDisplayNames,
+	)
+	deviceLocations := authService.PolicyMiddleware(
+		deviceLocationsPolicy,
+		auth.ScopeFleetRead,
+		deviceService.HandleGetDeviceLocations,
+	)
+	router.HandleFunc("GET /display-names", deprecated("/api/v1/devices/display-names", displayNames))
+	router.HandleFunc("GET /device-locations", deprecated("/api/v1/devices/locations", deviceLocations))
+	router.HandleFunc(
+		"POST /hide-device",
+		deprecated(
+			"/api/v1/devices/{id}/settings",
+			authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleHideDevice),
+		),
+	)
+	router.HandleFunc(
+		"GET /get-hidden-devices",
+		deprecated(
+			"/api/v1/devices/hidden",
+			authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetHiddenDevices),
+		),
+	)
+	router.HandleFunc(
+		"POST /change-color",
+		deprecated(
+			"/api/v1/devices/{id}/settings",
+			authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleChangeColor),
+		),
+	)
+	router.HandleFunc(
+		"GET /get-device-settings",
+		deprecated(
+			"/api/v1/devices",
+			authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetDeviceSettings),
+		),
+	)
+	router.HandleFunc(
+		"POST /change-nickname",
+		deprecated(
+			"/api/v1/devices/{id}/settings",
+			authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleChangeNickname),
+		),
+	)
+	router.HandleFunc(
+		"POST /device-settings/batch",
+		deprecated(
+			"/api/v1/devices/settings",
+			authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandlePatchDeviceSettings),
+		),
+	)
+	router.HandleFunc(
+		"POST /credentials",
+		deprecated(
+			"/api/v1/credentials",
+			authService.SessionAuthMiddleware(deviceService.HandleSetUserCredentials),
+		),
+	)
+	router.HandleFunc(
+		"GET /device-groups",
+		deprecated(
+			"/api/v1/device-groups",
+			authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetDeviceGroups),
+		),
+	)
+	router.HandleFunc(
+		"POST /device-groups/create",
+		deprecated(
+			"/api/v1/device-groups",
+			authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleCreateDeviceGroup),
+		),
+	)
+	router.HandleFunc(
+		"POST /device-groups/delete",
+		deprecated(
+			"/api/v1/device-groups/{id}",
+			authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleDeleteDeviceGroup),
+		),
+	)
+	router.HandleFunc(
+		"POST /device-groups/update",
+		deprecated(
+			"/api/v1/device-groups/{id}",
+			authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleUpdateDeviceGroup),
+		),
+	)
+	router.HandleFunc(
+		"POST /device-groups/settings",
+		deprecated(
+			"/api/v1/device-groups/{id}/settings",
+			authService.ScopedAuthMiddleware(
+				auth.ScopeSettingsWrite,
+				deviceService.HandleUpdateDeviceGroupSettings,
+			),
+		),
+	)
+	router.HandleFunc(
+		"GET /device-tags",
+		deprecated(
+			"/api/v1/device-tags",
+			authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetDeviceTags),
+		),
+	)
+	router.HandleFunc(
+		"POST /device-tags/set",
+		deprecated(
+			"/api/v1/devices/{id}/tags",
+			authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleSetDeviceTags),
+		),
+	)
+	router.HandleFunc(
+		"GET /share-links",
+		deprecated("/api/v1/share-links", authService.AuthMiddleware(deviceService.HandleGetShareLinks)),
+	)
+	router.HandleFunc(
+		"POST /share-links/create",
+		deprecated("/api/v1/share-links", authService.AuthMiddleware(deviceService.HandleCreateShareLink)),
+	)
+	router.HandleFunc(
+		"POST /share-links/revoke",
+		deprecated(
+			"/api/v1/share-links/{id}",
+			authService.AuthMiddleware(deviceService.HandleRevokeShareLink),
+		),
+	)
+	router.HandleFunc(
+		"GET /shared/{token}",
+		deprecated("/api/v1/shared/{token}", deviceService.HandleGetSharedDevices),
+	)
+	router.HandleFunc(
+		"GET /tiles/{z}/{x}/{y}",
+		deprecated(
+			"/api/v1/tiles/{z}/{x}/{y}",
+			authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetTile),
+		),
+	)
+	router.HandleFunc(
+		"GET /organizations",
+		deprecated(
+			"/api/v1/organizations",
+			authService.AuthMiddleware(organizationService.HandleGetOrganizations),
+		),
+	)
 	router.HandleFunc(
-		"/update-username",
-		authService.AuthMiddleware(authService.HandleUpdateUsername),
+		"POST /organizations/create",
+		deprecated(
+			"/api/v1/organizations",
+			authService.AuthMiddleware(organizationService.HandleCreateOrganization),
+		),
+	)
+	router.HandleFunc(
+		"GET /organizations/members",
+		deprecated(
+			"/api/v1/organizations/members",
+			authService.AuthMiddleware(organizationService.HandleGetMembers),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/members/set",
+		deprecated(
+			"/api/v1/organizations/members/{username}",
+			authService.AuthMiddleware(organizationService.HandleSetMember),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/members/remove",
+		deprecated(
+			"/api/v1/organizations/members/{username}",
+			authService.AuthMiddleware(organizationService.HandleRemoveMember),
+		),
+	)
+	router.HandleFunc(
+		"GET /organizations/groups",
+		deprecated(
+			"/api/v1/organizations/groups",
+			authService.AuthMiddleware(organizationService.HandleGetGroups),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/groups/create",
+		deprecated(
+			"/api/v1/organizations/groups",
+			authService.AuthMiddleware(organizationService.HandleCreateGroup),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/groups/delete",
+		deprecated(
+			"/api/v1/organizations/groups/{id}",
+			authService.AuthMiddleware(organizationService.HandleDeleteGroup),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/groups/members/add",
+		deprecated(
+			"/api/v1/organizations/groups/{id}/members/{username}",
+			authService.AuthMiddleware(organizationService.HandleAddGroupMember),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/groups/members/remove",
+		deprecated(
+			"/api/v1/organizations/groups/{id}/members/{username}",
+			authService.AuthMiddleware(organizationService.HandleRemoveGroupMember),
+		),
+	)
+	router.HandleFunc(
+		"GET /organizations/grants",
+		deprecated(
+			"/api/v1/organizations/grants",
+			authService.AuthMiddleware(organizationService.HandleGetDeviceGrants),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/grants/create",
+		deprecated(
+			"/api/v1/organizations/grants",
+			authService.AuthMiddleware(organizationService.HandleCreateDeviceGrant),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/grants/delete",
+		deprecated(
+			"/api/v1/organizations/grants/{id}",
+			authService.AuthMiddleware(organizationService.HandleDeleteDeviceGrant),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/credentials",
+		deprecated(
+			"/api/v1/organizations/credentials",
+			authService.SessionAuthMiddleware(deviceService.HandleSetOrganizationCredentials),
+		),
+	)
+	router.HandleFunc(
+		"GET /organizations/device-defaults",
+		deprecated(
+			"/api/v1/organizations/device-defaults",
+			authService.ScopedAuthMiddleware(auth.ScopeFleetRead, organizationService.HandleGetDeviceDefaults),
+		),
+	)
+	router.HandleFunc(
+		"POST /organizations/device-defaults/set",
+		deprecated(
+			"/api/v1/organizations/device-defaults/{id}",
+			authService.ScopedAuthMiddleware(
+				auth.ScopeSettingsWrite,
+				organizationService.HandleSetDeviceDefaults,
+			),
+		),
 	)
 
-	router.HandleFunc("/display-names", deviceService.HandleGetDisplayNames)
-	router.HandleFunc("/device-locations", deviceService.HandleGetDeviceLocations)
-	router.HandleFunc("/hide-device", authService.AuthMiddleware(deviceService.HandleHideDevice))
+	// Version 1 of the REST API. The routes above that it replaces are deprecated aliases.
+	router.HandleFunc("GET /api/v1/me", authService.AuthMiddleware(authService.HandleGetProfile))
+	router.HandleFunc(
+		"GET /api/v1/tokens",
+		authService.SessionAuthMiddleware(authService.HandleGetAccessTokens),
+	)
+	router.HandleFunc(
+		"POST /api/v1/tokens",
+		authService.SessionAuthMiddleware(authService.HandleCreateAccessToken),
+	)
+	router.HandleFunc(
+		"DELETE /api/v1/tokens/{id}",
+		authService.SessionAuthMiddleware(authService.HandleDeleteAccessToken),
+	)
+	router.HandleFunc(
+		"PUT /api/v1/credentials",
+		authService.SessionAuthMiddleware(deviceService.HandleSetUserCredentials),
+	)
+	router.HandleFunc(
+		"GET /api/v1/devices",
+		authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetDeviceSettings),
+	)
+	router.HandleFunc("GET /api/v1/devices/locations", deviceLocations)
+	router.HandleFunc("GET /api/v1/devices/display-names", displayNames)
+	router.HandleFunc(
+		"GET /api/v1/devices/hidden",
+		authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetHiddenDevices),
+	)
+	router.HandleFunc(
+		"PATCH /api/v1/devices/settings",
+		authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandlePatchDeviceSettings),
+	)
+	router.HandleFunc(
+		"GET /api/v1/devices/{id}/settings",
+		authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetDeviceSettingsByID),
+	)
+	router.HandleFunc(
+		"PATCH /api/v1/devices/{id}/settings",
+		authService.ScopedAuthMiddleware(
+			auth.ScopeSettingsWrite,
+			deviceService.HandlePatchDeviceSettingsByID,
+		),
+	)
 	router.HandleFunc(
-		"/get-hidden-devices",
-		authService.AuthMiddleware(deviceService.HandleGetHiddenDevices),
+		"PUT /api/v1/devices/{id}/tags",
+		authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleSetDeviceTags),
 	)
-	router.HandleFunc("/change-color", authService.AuthMiddleware(deviceService.HandleChangeColor))
 	router.HandleFunc(
-		"/get-device-settings",
-		authService.AuthMiddleware(deviceService.HandleGetDeviceSettings),
+		"GET /api/v1/device-tags",
+		authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetDeviceTags),
 	)
 	router.HandleFunc(
-		"/change-nickname",
-		authService.AuthMiddleware(deviceService.HandleChangeNickname),
+		"GET /api/v1/device-groups",
+		authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetDeviceGroups),
+	)
+	router.HandleFunc(
+		"POST /api/v1/device-groups",
+		authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleCreateDeviceGroup),
+	)
+	router.HandleFunc(
+		"PATCH /api/v1/device-groups/{id}",
+		authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleUpdateDeviceGroup),
+	)
+	router.HandleFunc(
+		"DELETE /api/v1/device-groups/{id}",
+		authService.ScopedAuthMiddleware(auth.ScopeSettingsWrite, deviceService.HandleDeleteDeviceGroup),
+	)
+	router.HandleFunc(
+		"PATCH /api/v1/device-groups/{id}/settings",
+		authService.ScopedAuthMiddleware(
+			auth.ScopeSettingsWrite,
+			deviceService.HandleUpdateDeviceGroupSettings,
+		),
+	)
+	router.HandleFunc(
+		"GET /api/v1/share-links",
+		authService.AuthMiddleware(deviceService.HandleGetShareLinks),
+	)
+	router.HandleFunc(
+		"POST /api/v1/share-links",
+		authService.AuthMiddleware(deviceService.HandleCreateShareLink),
+	)
+	router.HandleFunc(
+		"DELETE /api/v1/share-links/{id}",
+		authService.AuthMiddleware(deviceService.HandleRevokeShareLink),
+	)
+	router.HandleFunc("GET /api/v1/shared/{token}", deviceService.HandleGetSharedDevices)
+	router.HandleFunc(
+		"GET /api/v1/tiles/{z}/{x}/{y}",
+		authService.ScopedAuthMiddleware(auth.ScopeFleetRead, deviceService.HandleGetTile),
+	)
+	router.HandleFunc(
+		"GET /api/v1/organizations",
+		authService.AuthMiddleware(organizationService.HandleGetOrganizations),
+	)
+	router.HandleFunc(
+		"POST /api/v1/organizations",
+		authService.AuthMiddleware(organizationService.HandleCreateOrganization),
+	)
+	router.HandleFunc(
+		"GET /api/v1/organizations/members",
+		authService.AuthMiddleware(organizationService.HandleGetMembers),
+	)
+	router.HandleFunc(
+		"PUT /api/v1/organizations/members/{username}",
+		authService.AuthMiddleware(organizationService.HandleSetMember),
+	)
+	router.HandleFunc(
+		"DELETE /api/v1/organizations/members/{username}",
+		authService.AuthMiddleware(organizationService.HandleRemoveMember),
+	)
+	router.HandleFunc(
+		"GET /api/v1/organizations/groups",
+		authService.AuthMiddleware(organizationService.HandleGetGroups),
+	)
+	router.HandleFunc(
+		"POST /api/v1/organizations/groups",
+		authService.AuthMiddleware(organizationService.HandleCreateGroup),
+	)
+	router.HandleFunc(
+		"DELETE /api/v1/organizations/groups/{id}",
+		authService.AuthMiddleware(organizationService.HandleDeleteGroup),
+	)
+	router.HandleFunc(
+		"PUT /api/v1/organizations/groups/{id}/members/{username}",
+		authService.AuthMiddleware(organizationService.HandleAddGroupMember),
+	)
+	router.HandleFunc(
+		"DELETE /api/v1/organizations/groups/{id}/members/{username}",
+		authService.AuthMiddleware(organizationService.HandleRemoveGroupMember),
+	)
+	router.HandleFunc(
+		"GET /api/v1/organizations/grants",
+		authService.AuthMiddleware(organizationService.HandleGetDeviceGrants),
+	)
+	router.HandleFunc(
+		"POST /api/v1/organizations/grants",
+		authService.AuthMiddleware(organizationService.HandleCreateDeviceGrant),
+	)
+	router.HandleFunc(
+		"DELETE /api/v1/organizations/grants/{id}",
+		authService.AuthMiddleware(organizationService.HandleDeleteDeviceGrant),
+	)
+	router.HandleFunc(
+		"PUT /api/v1/organizations/credentials",
+		authService.SessionAuthMiddleware(deviceService.HandleSetOrganizationCredentials),
+	)
+	router.HandleFunc(
+		"GET /api/v1/organizations/device-defaults",
+		authService.ScopedAuthMiddleware(auth.ScopeFleetRead, organizationService.HandleGetDeviceDefaults),
+	)
+	router.HandleFunc(
+		"PATCH /api/v1/organizations/device-defaults/{id}",
+		authService.ScopedAuthMiddleware(
+			auth.ScopeSettingsWrite,
+			organizationService.HandleSetDeviceDefaults,
+		),
 	)
 
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", auth.OrganizationHeader},
 	})
 	handler := c.Handler(router)
 	http.ListenAndServe(":8080", handler)
 }
+
+// deprecated marks the responses of a route that a route of the versioned API replaces with the
+// Deprecation header and a Link header to its successor.
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		handler(w, r)
+	}
+}
@@ -1,13 +1,26 @@
 package models
 
+import "time"
+
 type Device struct {
-	DeviceID    string  `json:"device_id"`
-	DisplayName string  `json:"display_name"`
-	Latitude    float64 `json:"latitude"`
-	Longitude   float64 `json:"longitude"`
-	Altitude    float64 `json:"altitude"`
-	Angle       float64 `json:"angle"`
-	IsHidden    bool    `json:"is_hidden"`
-	Color       string  `json:"color"`
-	Nickname    string  `json:"nickname"`
+	DeviceID    string    `json:"device_id"`
+	DisplayName string    `json:"display_name"`
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	Altitude    float64   `json:"altitude"`
+	Angle       float64   `json:"angle"`
+	Speed       float64   `json:"speed"`
+	Velocity    *Velocity `json:"velocity,omitempty"`
+	IsHidden    bool      `json:"is_hidden"`
+	Color       string    `json:"color"`
+	Nickname    string    `json:"nickname"`
+}
+
+// Velocity is the estimated motion of a device at its last fix, used to extrapolate its position
+// until the next poll. The position may only be extrapolated between FixTime and ValidUntil.
+type Velocity struct {
+	North      float64   `json:"north"`
+	East       float64   `json:"east"`
+	FixTime    time.Time `json:"fix_time"`
+	ValidUntil time.Time `json:"valid_until"`
 }
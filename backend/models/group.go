@@ -0,0 +1,8 @@
+package models
+
+// DeviceGroup is a named set of devices of a user's or an organization's fleet.
+type DeviceGroup struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	DeviceIDs []string `json:"device_ids"`
+}
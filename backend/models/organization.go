@@ -0,0 +1,45 @@
+package models
+
+// Organization owns a fleet through its OneStepGPS credentials and shares it with its members.
+type Organization struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Role           string `json:"role"`
+	HasCredentials bool   `json:"has_credentials"`
+}
+
+// Member is a user's membership in an organization. Restricted members only have access to the
+// devices granted to them.
+type Member struct {
+	UserID     int    `json:"user_id"`
+	Username   string `json:"username"`
+	Role       string `json:"role"`
+	Restricted bool   `json:"restricted"`
+}
+
+// DeviceDefaults are an organization's default settings for a device. Nil fields are not set, and
+// members' own settings take precedence over the set ones.
+type DeviceDefaults struct {
+	DeviceID string  `json:"device_id"`
+	IsHidden *bool   `json:"is_hidden"`
+	Nickname *string `json:"nickname"`
+	Color    *string `json:"color"`
+}
+
+// Group is a named set of an organization's members that devices can be granted to.
+type Group struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// DeviceGrant gives a member or a group of an organization access to a device. Access is either
+// "view" or "edit".
+type DeviceGrant struct {
+	ID       int    `json:"id"`
+	DeviceID string `json:"device_id"`
+	UserID   *int   `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	GroupID  *int   `json:"group_id,omitempty"`
+	Access   string `json:"access"`
+}
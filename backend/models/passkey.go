@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Passkey is a WebAuthn credential registered by a user to log in without a password.
+type Passkey struct {
+	ID              int        `json:"id"`
+	UserID          int        `json:"-"`
+	Name            string     `json:"name"`
+	CredentialID    []byte     `json:"-"`
+	PublicKey       []byte     `json:"-"`
+	AttestationType string     `json:"-"`
+	Transports      []string   `json:"-"`
+	SignCount       uint32     `json:"-"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+}
@@ -9,6 +9,8 @@ type DeviceResponse struct {
 		Longitude float64 `json:"lng"`
 		Altitude  float64 `json:"altitude"`
 		Angle     float64 `json:"angle"`
+		Speed     float64 `json:"speed"`
+		DtTracker string  `json:"dt_tracker"`
 	} `json:"latest_device_point"`
 }
 
@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// ShareLink lets anyone with its token follow the live location of some devices of a user's fleet
+// until it expires or is revoked. The token itself is only shown once, when the link is created.
+type ShareLink struct {
+	ID             int        `json:"id"`
+	UserID         int        `json:"-"`
+	OrganizationID *int       `json:"organization_id"`
+	Name           string     `json:"name"`
+	DeviceIDs      []string   `json:"device_ids"`
+	WindowStart    *time.Time `json:"window_start"`
+	WindowEnd      *time.Time `json:"window_end"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+	ViewCount      int        `json:"view_count"`
+	LastViewedAt   *time.Time `json:"last_viewed_at"`
+}
+
+// SharedDevices is what a share link shows.
+type SharedDevices struct {
+	Name      string    `json:"name"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Devices   []Device  `json:"devices"`
+}
+
+// ShareLinkViews are views of a share link that have yet to be counted.
+type ShareLinkViews struct {
+	LinkID       int
+	Count        int
+	LastViewedAt time.Time
+}
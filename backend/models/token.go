@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// AccessToken is a personal access token a user created for scripts and integrations. The token
+// itself is only shown once, when it is created.
+type AccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
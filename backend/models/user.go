@@ -3,16 +3,28 @@ package models
 type User struct {
 	ID             int              `json:"id"`
 	Username       string           `json:"username"`
+	Email          string           `json:"email"`
 	Password       string           `json:"password"`
 	PasswordHash   string           `json:"-"`
+	TOTPEnabled    bool             `json:"-"`
+	EmailVerified  bool             `json:"-"`
 	DeviceSettings []DeviceSettings `json:"device_settings"`
 }
 
 type DeviceSettings struct {
 	ID       int    `json:"id"`
 	DeviceID string `json:"device_id"`
-	Username string `json:"username"`
+	UserID   int    `json:"user_id"`
 	IsHidden bool   `json:"is_hidden"`
 	Nickname string `json:"nickname"`
 	Color    string `json:"color"`
 }
+
+// DeviceSettingsPatch changes some of a user's settings for a device. Nil fields are left
+// unchanged.
+type DeviceSettingsPatch struct {
+	DeviceID string  `json:"device_id"`
+	IsHidden *bool   `json:"is_hidden"`
+	Nickname *string `json:"nickname"`
+	Color    *string `json:"color"`
+}
@@ -0,0 +1,237 @@
+// Package mvt encodes point features as Mapbox Vector Tiles (version 2.1 of the specification).
+// Only the subset of the protobuf schema needed by the backend is implemented, so the package
+// has no dependencies outside the standard library.
+package mvt
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// Extent is the number of integer units along each side of a tile.
+const Extent = 4096
+
+// Buffer is the number of tile units outside of the tile bounds in which points are still
+// encoded, so that markers straddling a tile edge are drawn by both neighbouring tiles.
+const Buffer = 64
+
+// Geometry types from the vector tile specification.
+const (
+	geomTypePoint = 1
+)
+
+// Geometry commands from the vector tile specification.
+const (
+	commandMoveTo = 1
+)
+
+// Protobuf wire types.
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+)
+
+// TileID identifies a tile in the XYZ (slippy map) tiling scheme.
+type TileID struct {
+	Z uint32
+	X uint32
+	Y uint32
+}
+
+// Valid reports whether the tile coordinates exist at the tile's zoom level.
+func (t TileID) Valid() bool {
+	if t.Z > 30 {
+		return false
+	}
+	n := uint32(1) << t.Z
+	return t.X < n && t.Y < n
+}
+
+// Project converts a WGS84 coordinate to integer coordinates relative to the tile, using the
+// Web Mercator projection. The second return value is false if the point lies outside of the
+// tile and its buffer.
+func (t TileID) Project(lat float64, lng float64) (int32, int32, bool) {
+	// Clamp to the latitude range covered by Web Mercator
+	lat = math.Max(math.Min(lat, 85.05112878), -85.05112878)
+
+	n := float64(uint64(1) << t.Z)
+	latRad := lat * math.Pi / 180
+	worldX := (lng + 180) / 360 * n
+	worldY := (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n
+
+	// Check the bounds before converting, far away points at high zoom levels overflow int32
+	x := math.Floor((worldX - float64(t.X)) * Extent)
+	y := math.Floor((worldY - float64(t.Y)) * Extent)
+	if x < -Buffer || x >= Extent+Buffer || y < -Buffer || y >= Extent+Buffer {
+		return 0, 0, false
+	}
+	return int32(x), int32(y), true
+}
+
+// Feature is a single point feature in a layer. Property values may be strings, bools, signed or
+// unsigned integers and floating point numbers; values of any other type are skipped.
+type Feature struct {
+	ID         uint64
+	X          int32
+	Y          int32
+	Properties map[string]interface{}
+}
+
+// Layer is a named collection of features.
+type Layer struct {
+	Name     string
+	Features []Feature
+}
+
+// Encode serializes the layers into a vector tile. Layers without features are omitted.
+func Encode(layers []Layer) []byte {
+	var tile []byte
+	for _, layer := range layers {
+		if len(layer.Features) == 0 {
+			continue
+		}
+		tile = appendBytesField(tile, 3, encodeLayer(layer))
+	}
+	return tile
+}
+
+// encodeLayer serializes a single layer, deduplicating its property keys and values.
+func encodeLayer(layer Layer) []byte {
+	var keys []string
+	keyIndex := make(map[string]uint32)
+	var values [][]byte
+	valueIndex := make(map[string]uint32)
+
+	var buf []byte
+	buf = appendVarintField(buf, 15, 2)
+	buf = appendBytesField(buf, 1, []byte(layer.Name))
+
+	for _, feature := range layer.Features {
+		// Sort the property names so the encoding is deterministic
+		names := make([]string, 0, len(feature.Properties))
+		for name := range feature.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var tags []uint64
+		for _, name := range names {
+			value, ok := encodeValue(feature.Properties[name])
+			if !ok {
+				continue
+			}
+			ki, ok := keyIndex[name]
+			if !ok {
+				ki = uint32(len(keys))
+				keyIndex[name] = ki
+				keys = append(keys, name)
+			}
+			vi, ok := valueIndex[string(value)]
+			if !ok {
+				vi = uint32(len(values))
+				valueIndex[string(value)] = vi
+				values = append(values, value)
+			}
+			tags = append(tags, uint64(ki), uint64(vi))
+		}
+
+		geometry := []uint64{
+			commandInteger(commandMoveTo, 1),
+			zigzag(feature.X),
+			zigzag(feature.Y),
+		}
+
+		var f []byte
+		if feature.ID != 0 {
+			f = appendVarintField(f, 1, feature.ID)
+		}
+		if len(tags) > 0 {
+			f = appendPackedField(f, 2, tags)
+		}
+		f = appendVarintField(f, 3, geomTypePoint)
+		f = appendPackedField(f, 4, geometry)
+		buf = appendBytesField(buf, 2, f)
+	}
+
+	for _, key := range keys {
+		buf = appendBytesField(buf, 3, []byte(key))
+	}
+	for _, value := range values {
+		buf = appendBytesField(buf, 4, value)
+	}
+	buf = appendVarintField(buf, 5, Extent)
+	return buf
+}
+
+// encodeValue serializes a property value as a vector tile Value message.
+func encodeValue(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case string:
+		return appendBytesField(nil, 1, []byte(v)), true
+	case float32:
+		return appendFixed64Field(nil, 3, math.Float64bits(float64(v))), true
+	case float64:
+		return appendFixed64Field(nil, 3, math.Float64bits(v)), true
+	case int:
+		return appendVarintField(nil, 6, zigzag64(int64(v))), true
+	case int32:
+		return appendVarintField(nil, 6, zigzag64(int64(v))), true
+	case int64:
+		return appendVarintField(nil, 6, zigzag64(v)), true
+	case uint:
+		return appendVarintField(nil, 5, uint64(v)), true
+	case uint32:
+		return appendVarintField(nil, 5, uint64(v)), true
+	case uint64:
+		return appendVarintField(nil, 5, v), true
+	case bool:
+		var b uint64
+		if v {
+			b = 1
+		}
+		return appendVarintField(nil, 7, b), true
+	}
+	return nil, false
+}
+
+func commandInteger(id uint32, count uint32) uint64 {
+	return uint64((id & 0x7) | (count << 3))
+}
+
+func zigzag(n int32) uint64 {
+	return uint64(uint32((n << 1) ^ (n >> 31)))
+}
+
+func zigzag64(n int64) uint64 {
+	return uint64((n << 1) ^ (n >> 63))
+}
+
+func appendTag(buf []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(field<<3|wireType))
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendTag(buf, field, wireVarint)
+	return binary.AppendUvarint(buf, v)
+}
+
+func appendFixed64Field(buf []byte, field int, v uint64) []byte {
+	buf = appendTag(buf, field, wire64Bit)
+	return binary.LittleEndian.AppendUint64(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, v []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendPackedField(buf []byte, field int, vs []uint64) []byte {
+	var packed []byte
+	for _, v := range vs {
+		packed = binary.AppendUvarint(packed, v)
+	}
+	return appendBytesField(buf, field, packed)
+}
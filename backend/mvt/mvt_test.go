@@ -0,0 +1,284 @@
+package mvt
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// field is a decoded protobuf field. Varint and 64-bit fields keep their value in v, length
+// delimited fields their content in b.
+type field struct {
+	num int
+	v   uint64
+	b   []byte
+}
+
+// decodeFields splits a protobuf message into its fields.
+func decodeFields(t *testing.T, buf []byte) []field {
+	t.Helper()
+	var fields []field
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			t.Fatalf("invalid tag in %x", buf)
+		}
+		buf = buf[n:]
+		f := field{num: int(tag >> 3)}
+		switch tag & 0x7 {
+		case wireVarint:
+			f.v, n = binary.Uvarint(buf)
+			if n <= 0 {
+				t.Fatalf("invalid varint in field %d", f.num)
+			}
+			buf = buf[n:]
+		case wire64Bit:
+			if len(buf) < 8 {
+				t.Fatalf("short 64-bit field %d", f.num)
+			}
+			f.v = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < length {
+				t.Fatalf("invalid length of field %d", f.num)
+			}
+			f.b = buf[n : n+int(length)]
+			buf = buf[n+int(length):]
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", tag&0x7, f.num)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// decodePacked decodes a packed repeated varint field.
+func decodePacked(t *testing.T, buf []byte) []uint64 {
+	t.Helper()
+	var vs []uint64
+	for len(buf) > 0 {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			t.Fatalf("invalid packed varint in %x", buf)
+		}
+		vs = append(vs, v)
+		buf = buf[n:]
+	}
+	return vs
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// decodedFeature is a point feature as read back from an encoded layer.
+type decodedFeature struct {
+	id         uint64
+	geomType   uint64
+	x          int64
+	y          int64
+	properties map[string]interface{}
+}
+
+// decodeLayer reads back a layer encoded by Encode, resolving the tags of its features.
+func decodeLayer(t *testing.T, buf []byte) (string, uint64, uint64, []decodedFeature) {
+	t.Helper()
+	var name string
+	var version, extent uint64
+	var keys []string
+	var values []interface{}
+	var rawFeatures [][]byte
+	for _, f := range decodeFields(t, buf) {
+		switch f.num {
+		case 15:
+			version = f.v
+		case 1:
+			name = string(f.b)
+		case 2:
+			rawFeatures = append(rawFeatures, f.b)
+		case 3:
+			keys = append(keys, string(f.b))
+		case 4:
+			value := decodeFields(t, f.b)
+			if len(value) != 1 {
+				t.Fatalf("value with %d fields", len(value))
+			}
+			switch value[0].num {
+			case 1:
+				values = append(values, string(value[0].b))
+			case 3:
+				values = append(values, math.Float64frombits(value[0].v))
+			case 5:
+				values = append(values, value[0].v)
+			case 6:
+				values = append(values, unzigzag(value[0].v))
+			case 7:
+				values = append(values, value[0].v == 1)
+			default:
+				t.Fatalf("unexpected value field %d", value[0].num)
+			}
+		case 5:
+			extent = f.v
+		}
+	}
+
+	var features []decodedFeature
+	for _, raw := range rawFeatures {
+		feature := decodedFeature{properties: make(map[string]interface{})}
+		for _, f := range decodeFields(t, raw) {
+			switch f.num {
+			case 1:
+				feature.id = f.v
+			case 2:
+				tags := decodePacked(t, f.b)
+				if len(tags)%2 != 0 {
+					t.Fatalf("odd number of tags %v", tags)
+				}
+				for i := 0; i < len(tags); i += 2 {
+					feature.properties[keys[tags[i]]] = values[tags[i+1]]
+				}
+			case 3:
+				feature.geomType = f.v
+			case 4:
+				geometry := decodePacked(t, f.b)
+				if len(geometry) != 3 {
+					t.Fatalf("point geometry %v, want 3 integers", geometry)
+				}
+				if id, count := geometry[0]&0x7, geometry[0]>>3; id != commandMoveTo || count != 1 {
+					t.Fatalf("command %d with count %d, want MoveTo with count 1", id, count)
+				}
+				feature.x = unzigzag(geometry[1])
+				feature.y = unzigzag(geometry[2])
+			}
+		}
+		features = append(features, feature)
+	}
+	return name, version, extent, features
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	features := []Feature{
+		{ID: 1, X: 0, Y: 0, Properties: map[string]interface{}{"name": "a", "moving": true}},
+		{
+			ID:         2,
+			X:          -Buffer,
+			Y:          Extent + Buffer - 1,
+			Properties: map[string]interface{}{"name": "b", "angle": 270},
+		},
+		{ID: 3, X: 1, Y: -1, Properties: map[string]interface{}{"speed": 12.5, "odometer": uint64(300)}},
+		{X: Extent / 2, Y: Extent / 2, Properties: map[string]interface{}{"skipped": []int{1}}},
+	}
+	tile := Encode([]Layer{{Name: "devices", Features: features}, {Name: "empty"}})
+
+	layers := decodeFields(t, tile)
+	if len(layers) != 1 || layers[0].num != 3 {
+		t.Fatalf("tile fields %v, want a single layer", layers)
+	}
+	name, version, extent, decoded := decodeLayer(t, layers[0].b)
+	if name != "devices" || version != 2 || extent != Extent {
+		t.Errorf(
+			"layer %q version %d extent %d, want %q version 2 extent %d",
+			name,
+			version,
+			extent,
+			"devices",
+			Extent,
+		)
+	}
+	if len(decoded) != len(features) {
+		t.Fatalf("%d features, want %d", len(decoded), len(features))
+	}
+
+	wantProperties := []map[string]interface{}{
+		{"name": "a", "moving": true},
+		{"name": "b", "angle": int64(270)},
+		{"speed": 12.5, "odometer": uint64(300)},
+		{},
+	}
+	for i, feature := range decoded {
+		if feature.id != features[i].ID || feature.geomType != geomTypePoint {
+			t.Errorf(
+				"feature %d: id %d type %d, want id %d type %d",
+				i,
+				feature.id,
+				feature.geomType,
+				features[i].ID,
+				geomTypePoint,
+			)
+		}
+		if feature.x != int64(features[i].X) || feature.y != int64(features[i].Y) {
+			t.Errorf(
+				"feature %d: point (%d, %d), want (%d, %d)",
+				i,
+				feature.x,
+				feature.y,
+				features[i].X,
+				features[i].Y,
+			)
+		}
+		if len(feature.properties) != len(wantProperties[i]) {
+			t.Errorf("feature %d: properties %v, want %v", i, feature.properties, wantProperties[i])
+			continue
+		}
+		for key, want := range wantProperties[i] {
+			if got := feature.properties[key]; got != want {
+				t.Errorf("feature %d: %s = %v (%T), want %v (%T)", i, key, got, got, want, want)
+			}
+		}
+	}
+}
+
+func TestTileIDValid(t *testing.T) {
+	tests := []struct {
+		tile TileID
+		want bool
+	}{
+		{TileID{Z: 0, X: 0, Y: 0}, true},
+		{TileID{Z: 0, X: 1, Y: 0}, false},
+		{TileID{Z: 3, X: 7, Y: 7}, true},
+		{TileID{Z: 3, X: 8, Y: 0}, false},
+		{TileID{Z: 3, X: 0, Y: 8}, false},
+		{TileID{Z: 30, X: 1<<30 - 1, Y: 0}, true},
+		{TileID{Z: 31, X: 0, Y: 0}, false},
+	}
+	for _, test := range tests {
+		if got := test.tile.Valid(); got != test.want {
+			t.Errorf("%+v.Valid() = %v, want %v", test.tile, got, test.want)
+		}
+	}
+}
+
+func TestTileIDProject(t *testing.T) {
+	// One tile unit at zoom 0 is 360/4096 degrees of longitude
+	unit := 360.0 / Extent
+	tests := []struct {
+		name string
+		tile TileID
+		lat  float64
+		lng  float64
+		x    int32
+		y    int32
+		ok   bool
+	}{
+		{"center of the world", TileID{Z: 0}, 0, 0, Extent / 2, Extent / 2, true},
+		{"north west corner", TileID{Z: 0}, 85.0511, -180, 0, 0, true},
+		// Without the clamp the point would be a quarter of a tile above the top edge
+		{"clamped latitude", TileID{Z: 0}, 89, 0, Extent / 2, -1, true},
+		{"inside the west buffer", TileID{Z: 1, X: 1}, 0, -Buffer * unit / 2, -Buffer, Extent, true},
+		{"outside the west buffer", TileID{Z: 1, X: 1}, 0, -(Buffer + 1) * unit / 2, 0, 0, false},
+		{"outside the east buffer", TileID{Z: 1, X: 0}, 0, (Buffer + 1) * unit / 2, 0, 0, false},
+		{"far away at a high zoom level", TileID{Z: 30}, -85, 179, 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			x, y, ok := test.tile.Project(test.lat, test.lng)
+			if ok != test.ok {
+				t.Fatalf("Project() ok = %v, want %v", ok, test.ok)
+			}
+			if ok && (x != test.x || y != test.y) {
+				t.Errorf("Project() = (%d, %d), want (%d, %d)", x, y, test.x, test.y)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Package secrets encrypts credentials before they are stored in the database.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Box encrypts and decrypts secrets with AES-256-GCM under a key-encryption key (KEK). Sealed
+// secrets start with the ID of the KEK they were sealed with, so a KEK can be rotated by adding a
+// new current KEK and keeping the old one until every secret has been sealed again.
+type Box struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewBox creates a box that seals new secrets with the KEK whose ID is current. The keys map KEK IDs
+// to 32-byte AES-256 keys.
+func NewBox(current string, keys map[string][]byte) (*Box, error) {
+	box := &Box{current: current, keys: make(map[string]cipher.AEAD)}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes long", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		box.keys[id] = aead
+	}
+
+	if _, ok := box.keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q not found", current)
+	}
+	return box, nil
+}
+
+// LoadBox loads the KEKs from the environment. SECRETS_KEYS is a comma-separated list of id:value
+// entries, where the value is a base64 encoded 32-byte key, and SECRETS_CURRENT_KEY is the ID of
+// the KEK new secrets are sealed with. It returns nil if SECRETS_KEYS is not set, which disables
+// storing credentials.
+func LoadBox() (*Box, error) {
+	entries := os.Getenv("SECRETS_KEYS")
+	if entries == "" {
+		return nil, nil
+	}
+
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(entries, ",") {
+		id, value, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid SECRETS_KEYS entry %q, expected id:value", entry)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %q: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return NewBox(os.Getenv("SECRETS_CURRENT_KEY"), keys)
+}
+
+// Seal encrypts the secret with the current KEK. The context, such as the ID of the row the secret
+// is stored in, is authenticated but not stored, and the same context has to be passed to Open.
+// This stops a sealed secret from being copied to another row.
+func (b *Box) Seal(secret string, context string) (string, error) {
+	aead := b.keys[b.current]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(context))
+	return b.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Reseal seals the value again with the current KEK, so that the KEK it was sealed with can be
+// retired. Values without a KEK ID are plaintext secrets stored before they were encrypted, and
+// are sealed as they are. It also reports whether the value changed, which it doesn't if it is
+// already sealed with the current KEK.
+func (b *Box) Reseal(value string, context string) (string, bool, error) {
+	id, _, ok := strings.Cut(value, ":")
+	if ok && id == b.current {
+		return value, false, nil
+	}
+	secret := value
+	if ok {
+		var err error
+		secret, err = b.Open(value, context)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	sealed, err := b.Seal(secret, context)
+	if err != nil {
+		return "", false, err
+	}
+	return sealed, true, nil
+}
+
+// Open decrypts a secret sealed by Seal with the same context.
+func (b *Box) Open(sealed string, context string) (string, error) {
+	id, value, ok := strings.Cut(sealed, ":")
+	if !ok {
+		return "", errors.New("invalid sealed secret")
+	}
+	aead, ok := b.keys[id]
+	if !ok {
+		return "", fmt.Errorf("unknown key id %q", id)
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", errors.New("invalid sealed secret")
+	}
+	secret, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,126 @@
+package secrets
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func newTestBox(t *testing.T, current string) *Box {
+	t.Helper()
+	box, err := NewBox(current, map[string][]byte{
+		"old": bytes.Repeat([]byte{1}, 32),
+		"new": bytes.Repeat([]byte{2}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return box
+}
+
+func TestNewBox(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		name    string
+		current string
+		keys    map[string][]byte
+		wantErr bool
+	}{
+		{"valid", "a", map[string][]byte{"a": key}, false},
+		{"unknown current key", "b", map[string][]byte{"a": key}, true},
+		{"empty key id", "", map[string][]byte{"": key}, true},
+		{"key id with a colon", "a:b", map[string][]byte{"a:b": key}, true},
+		{"short key", "a", map[string][]byte{"a": key[:16]}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewBox(test.current, test.keys)
+			if (err != nil) != test.wantErr {
+				t.Errorf("NewBox() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	box := newTestBox(t, "new")
+	sealed, err := box.Seal("api-key", "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "new:") || strings.Contains(sealed, "api-key") {
+		t.Fatalf("Seal() = %q, want the plaintext encrypted under the new key", sealed)
+	}
+
+	tests := []struct {
+		name    string
+		sealed  string
+		context string
+		wantErr bool
+	}{
+		{"same context", sealed, "user:1", false},
+		{"wrong context", sealed, "user:2", true},
+		{"unknown key id", "other" + strings.TrimPrefix(sealed, "new"), "user:1", true},
+		{"other key id", "old" + strings.TrimPrefix(sealed, "new"), "user:1", true},
+		{"no key id", strings.TrimPrefix(sealed, "new:"), "user:1", true},
+		{"invalid base64", "new:!!!", "user:1", true},
+		{"too short", "new:AAAA", "user:1", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret, err := box.Open(test.sealed, test.context)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Open() error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && secret != "api-key" {
+				t.Errorf("Open() = %q, want %q", secret, "api-key")
+			}
+		})
+	}
+}
+
+func TestReseal(t *testing.T) {
+	oldBox := newTestBox(t, "old")
+	sealedWithOld, err := oldBox.Seal("api-key", "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := newTestBox(t, "new")
+	sealedWithNew, err := box.Seal("api-key", "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		context string
+		changed bool
+		wantErr bool
+	}{
+		{"plaintext", "api-key", "user:1", true, false},
+		{"sealed with the old key", sealedWithOld, "user:1", true, false},
+		{"sealed with the current key", sealedWithNew, "user:1", false, false},
+		{"sealed with the old key in another context", sealedWithOld, "user:2", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resealed, changed, err := box.Reseal(test.value, test.context)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Reseal() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if changed != test.changed {
+				t.Errorf("Reseal() changed = %v, want %v", changed, test.changed)
+			}
+			if !strings.HasPrefix(resealed, "new:") {
+				t.Errorf("Reseal() = %q, want it sealed with the new key", resealed)
+			}
+			if secret, err := box.Open(resealed, test.context); err != nil || secret != "api-key" {
+				t.Errorf("Open() of the resealed value = %q, %v", secret, err)
+			}
+		})
+	}
+}
@@ -5,13 +5,24 @@ export const useUserStore = defineStore({
     id: 'user',
     state: () => ({
         username: null as string | null,
+        // A single sign-on login that waits for the code of the user's second factor, or its error
+        challenge: null as { username: string, challengeToken: string } | null,
+        loginError: null as string | null,
     }),
     actions: {
         setUsername(username: string) {
             this.username = username;
         },
+        setChallenge(username: string, challengeToken: string) {
+            this.challenge = { username, challengeToken };
+        },
+        setLoginError(error: string) {
+            this.loginError = error;
+        },
         resetState() {
             this.username = null;
+            this.challenge = null;
+            this.loginError = null;
         }
     },
 });
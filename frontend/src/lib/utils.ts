@@ -9,8 +9,92 @@ export function cn(...inputs: ClassValue[]) {
   return twMerge(clsx(inputs))
 }
 
+// Refresh tokens are valid for 14 days, the access tokens they are exchanged for for 15 minutes
+const SESSION_DAYS = 14;
+
 export const isUserLoggedIn = () => {
-  return !!Cookies.get('token');
+  return !!Cookies.get('refresh_token');
+};
+
+// Stores the access and refresh token of a login, signup or refresh response.
+export const saveTokens = (json: { token: string, refresh_token: string }) => {
+  Cookies.set('token', json.token, { expires: SESSION_DAYS });
+  Cookies.set('refresh_token', json.refresh_token, { expires: SESSION_DAYS });
+};
+
+// Reads the result of a single sign-on login, which the backend puts in the URL fragment of the
+// page it redirects to, and removes it from the address bar and the history. The tokens of a
+// completed login are stored right away.
+export const consumeLoginFragment = () => {
+  const values = new URLSearchParams(window.location.hash.slice(1));
+  if (!values.has('token') && !values.has('challenge_token') && !values.has('error')) {
+    return null;
+  }
+  window.history.replaceState(null, '', window.location.pathname + window.location.search);
+  const token = values.get('token');
+  const refreshToken = values.get('refresh_token');
+  if (token && refreshToken) {
+    saveTokens({ token, refresh_token: refreshToken });
+  }
+  return values;
+};
+
+export const clearTokens = () => {
+  Cookies.remove('token');
+  Cookies.remove('refresh_token');
+};
+
+// Refreshes that are in flight, so that concurrent requests that find their access token expired
+// only use the refresh token once. Reusing a refresh token revokes the whole session.
+let refreshing: Promise<boolean> | null = null;
+
+const refreshTokens = () => {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const response = await fetch(`${import.meta.env.VITE_BACKEND_URL}/refresh`, {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+        },
+        body: JSON.stringify({
+          refresh_token: Cookies.get('refresh_token'),
+        }),
+      });
+      if (!response.ok) {
+        clearTokens();
+        return false;
+      }
+      saveTokens(await response.json());
+      return true;
+    })().finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+};
+
+// Calls an authenticated backend route. If the access token has expired, it is refreshed and the
+// request is sent again.
+export const authFetch = async (path: string, init: RequestInit = {}) => {
+  const send = () => {
+    const headers = new Headers(init.headers);
+    headers.set('Authorization', `Bearer ${Cookies.get('token')}`);
+    return fetch(`${import.meta.env.VITE_BACKEND_URL}${path}`, { ...init, headers });
+  };
+
+  const response = await send();
+  if (response.status !== 401 || !Cookies.get('refresh_token') || !(await refreshTokens())) {
+    return response;
+  }
+  return send();
+};
+
+// Ends the session on the backend and forgets its tokens.
+export const logout = async () => {
+  if (isUserLoggedIn()) {
+    await authFetch('/logout', { method: 'POST' }).catch(() => undefined);
+  }
+  clearTokens();
 };
 
 export function valueUpdater<T extends Updater<any>>(updaterOrValue: T, ref: Ref) {
@@ -23,12 +107,8 @@ export function valueUpdater<T extends Updater<any>>(updaterOrValue: T, ref: Ref
 export const fetchDevices = async () => {
   const deviceStore = useDeviceStore();
   if (isUserLoggedIn()) {
-      const token = Cookies.get('token');
-      const response = await fetch(`${import.meta.env.VITE_BACKEND_URL}/get-device-settings`, {
+      const response = await authFetch('/get-device-settings', {
           method: 'GET',
-          headers: {
-              Authorization: `Bearer ${token}`,
-          },
       });
       const json = await response.json();
       deviceStore.setDevices(json);
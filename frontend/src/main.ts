@@ -12,7 +12,8 @@ import StatisticsView from '@/views/StatisticsView.vue'
 import GoogleMapLoader from '@/components/GoogleMapLoader.vue'
 import AuthView from '@/views/AuthView.vue'
 
-import { isUserLoggedIn } from '@/lib/utils'
+import { consumeLoginFragment, isUserLoggedIn } from '@/lib/utils'
+import { useUserStore } from '@/lib/store'
 import { createPinia } from 'pinia'
 
 const app = createApp(App);
@@ -60,5 +61,25 @@ const router = createRouter({
     ],
 });
 
+// Finish a single sign-on login. Users with two-factor authentication and failed logins continue
+// on the login page.
+const login = consumeLoginFragment();
+if (login) {
+    const userStore = useUserStore();
+    const username = login.get('username') ?? '';
+    const challengeToken = login.get('challenge_token');
+    const error = login.get('error');
+    if (challengeToken) {
+        userStore.setChallenge(username, challengeToken);
+        router.replace('/login');
+    } else if (error) {
+        userStore.setLoginError(error);
+        router.replace('/login');
+    } else {
+        userStore.setUsername(username);
+        router.replace('/');
+    }
+}
+
 app.use(router);
 app.mount('#app')